@@ -3,63 +3,73 @@ package cryptography
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
-	"errors"
 	"fmt"
-	"io"
 )
 
 // EncryptAES шифрует данные с использованием AES-GCM.
+// Дополнительные данные additionalData не шифруются, но защищаются от подмены.
 // Возвращает зашифрованный текст в виде hex-строки.
-func EncryptAES(plainText, key []byte) (string, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", fmt.Errorf("error creating AES cipher: %w", err)
-	}
-
-	gcm, err := cipher.NewGCM(block)
+func EncryptAES(plainText, key, additionalData []byte) (string, error) {
+	cipherText, err := SealAES(plainText, key, additionalData)
 	if err != nil {
-		return "", fmt.Errorf("error creating GCM: %w", err)
+		return "", err
 	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", fmt.Errorf("error generating nonce: %w", err)
-	}
-
-	cipherText := gcm.Seal(nonce, nonce, plainText, nil)
 	return hex.EncodeToString(cipherText), nil
 }
 
 // DecryptAES расшифровывает данные, зашифрованные с использованием AES-GCM.
 // Принимает зашифрованный текст в виде hex-строки и возвращает расшифрованный текст.
-func DecryptAES(hexCipherText string, key []byte) (string, error) {
+// Дополнительные данные additionalData должны совпадать с переданными при шифровании.
+func DecryptAES(hexCipherText string, key, additionalData []byte) (string, error) {
 	cipherText, err := hex.DecodeString(hexCipherText)
 	if err != nil {
 		return "", fmt.Errorf("error decoding ciphertext: %w", err)
 	}
 
-	block, err := aes.NewCipher(key)
+	plainText, err := OpenAES(cipherText, key, additionalData)
+	if err != nil {
+		return "", err
+	}
+	return string(plainText), nil
+}
+
+// SealAES шифрует данные с использованием AES-GCM так же, как EncryptAES,
+// но возвращает шифротекст без кодирования: nonce, за которым следуют данные и тег.
+func SealAES(plainText, key, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
-		return "", fmt.Errorf("error creating AES cipher: %w", err)
+		return nil, err
 	}
+	return sealAEAD(gcm, plainText, additionalData)
+}
 
-	gcm, err := cipher.NewGCM(block)
+// OpenAES расшифровывает шифротекст, полученный от SealAES.
+func OpenAES(cipherText, key, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
-		return "", fmt.Errorf("error creating GCM: %w", err)
+		return nil, err
 	}
+	return openAEAD(gcm, cipherText, additionalData)
+}
 
-	nonceSize := gcm.NonceSize()
-	if len(cipherText) < nonceSize {
-		return "", errors.New("ciphertext too short")
+// newGCM создает AES-GCM с ключом key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating AES cipher: %w", err)
 	}
 
-	nonce, cipherText := cipherText[:nonceSize], cipherText[nonceSize:]
-	plainText, err := gcm.Open(nil, nonce, cipherText, nil)
+	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", fmt.Errorf("error decrypting message: %w", err)
+		return nil, fmt.Errorf("error creating GCM: %w", err)
 	}
+	return gcm, nil
+}
 
-	return string(plainText), nil
+// SequenceData кодирует порядковый номер сообщения для передачи в additionalData.
+// Привязка номера к шифротексту не позволяет повторно отправить сообщение с другим номером.
+func SequenceData(sequence uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, sequence)
 }
@@ -0,0 +1,52 @@
+package cryptography
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// handshakeDomain отделяет подписи стенограммы обмена ключами от любых других подписей
+// тем же ключом.
+const handshakeDomain = "cu/handshake/v1"
+
+// GenerateIdentityKey генерирует долговременный ключ подписи сервера Ed25519.
+func GenerateIdentityKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+// ParseIdentityKey разбирает публичный ключ подписи сервера в виде hex-строки.
+func ParseIdentityKey(hexKey string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode identity key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid identity key length: %d", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// HandshakeTranscript кодирует стенограмму обмена ключами: публичные ключи клиента
+// и сервера и идентификатор сессии. Каждое поле предваряется длиной, чтобы
+// разные наборы полей не давали одинаковую стенограмму.
+func HandshakeTranscript(clientPublicKey, serverPublicKey []byte, sessionID string) []byte {
+	transcript := []byte(handshakeDomain)
+	for _, field := range [][]byte{clientPublicKey, serverPublicKey, []byte(sessionID)} {
+		transcript = binary.BigEndian.AppendUint32(transcript, uint32(len(field)))
+		transcript = append(transcript, field...)
+	}
+	return transcript
+}
+
+// SignTranscript подписывает стенограмму обмена ключами ключом подписи сервера.
+func SignTranscript(identityKey ed25519.PrivateKey, transcript []byte) []byte {
+	return ed25519.Sign(identityKey, transcript)
+}
+
+// VerifyTranscript проверяет подпись стенограммы обмена ключами публичным ключом подписи сервера.
+func VerifyTranscript(identityKey ed25519.PublicKey, transcript, signature []byte) bool {
+	return len(identityKey) == ed25519.PublicKeySize && ed25519.Verify(identityKey, transcript, signature)
+}
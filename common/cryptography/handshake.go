@@ -0,0 +1,135 @@
+package cryptography
+
+import (
+	"crypto/sha256"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// handshakeProtocolName задает шаблон рукопожатия и примитивы. С него начинается хеш
+// стенограммы, поэтому рукопожатия разных версий не дадут одинаковых ключей и подписей.
+const handshakeProtocolName = "cu/handshake/NX_25519_SHA256/v2"
+
+// Рукопожатие устроено по шаблону NX из Noise Protocol Framework:
+//
+//	-> e
+//	<- e, ee, s, es
+//
+// Клиент отправляет эфемерный ключ e, сервер отвечает своим эфемерным ключом
+// и статическим ключом s. Ключ сессии зависит от обоих общих секретов:
+// ee дает прямую секретность — после удаления эфемерных ключей утечка статического
+// ключа сервера не раскрывает записанный трафик, — а es привязывает сессию
+// к статическому ключу сервера. Вместо шифрования s сервер подписывает
+// хеш стенограммы ключом подписи Ed25519. Пролог — данные, о которых стороны
+// договорились до рукопожатия, например предложенные наборы шифров, — входит
+// в стенограмму первым, и его подмена обнаруживается по подписи.
+//
+// Эталонные значения для проверки реализаций лежат в testdata/handshake_vectors.json.
+
+// HandshakeResult содержит результат рукопожатия, одинаковый у клиента и сервера.
+type HandshakeResult struct {
+	// SessionKey — сессионный ключ, из которого выводится ключ доступа.
+	SessionKey []byte
+	// Hash — хеш стенограммы рукопожатия. Сервер подписывает его ключом подписи,
+	// клиент проверяет подпись закрепленным ключом сервера.
+	Hash []byte
+}
+
+// handshakeState — состояние рукопожатия: цепочечный ключ, в который подмешиваются
+// общие секреты, и хеш стенограммы, в который подмешиваются открытые данные.
+type handshakeState struct {
+	chainingKey []byte
+	hash        []byte
+}
+
+// newHandshakeState создает начальное состояние рукопожатия.
+func newHandshakeState() *handshakeState {
+	hash := sha256.Sum256([]byte(handshakeProtocolName))
+	return &handshakeState{chainingKey: hash[:], hash: hash[:]}
+}
+
+// mixHash добавляет data в хеш стенограммы.
+func (s *handshakeState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.hash)
+	h.Write(data)
+	s.hash = h.Sum(nil)
+}
+
+// mixKey подмешивает общий секрет в цепочечный ключ.
+func (s *handshakeState) mixKey(sharedSecret []byte) error {
+	chainingKey, err := deriveKey(sharedSecret, s.chainingKey, []byte("ChainingKey"), 32)
+	if err != nil {
+		return err
+	}
+	s.chainingKey = chainingKey
+	return nil
+}
+
+// ClientHandshake завершает рукопожатие на стороне клиента по его эфемерному
+// приватному ключу ephemeralKey и публичным ключам сервера из ответа.
+// Пролог prologue равен nil в версиях протокола без пролога.
+func ClientHandshake(prologue []byte, ephemeralKey, serverEphemeralKey, serverStaticKey [32]byte, sessionID string) (*HandshakeResult, error) {
+	ephemeralPublicKey, err := curve25519.X25519(ephemeralKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	ee, err := ComputeSharedSecret(ephemeralKey, serverEphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	es, err := ComputeSharedSecret(ephemeralKey, serverStaticKey)
+	if err != nil {
+		return nil, err
+	}
+	return completeHandshake(prologue, ephemeralPublicKey, serverEphemeralKey[:], serverStaticKey[:], ee[:], es[:], sessionID)
+}
+
+// ServerHandshake завершает рукопожатие на стороне сервера по его эфемерному
+// и статическому приватным ключам и эфемерному ключу клиента clientEphemeralKey.
+// Пролог prologue должен совпадать с прологом клиента.
+func ServerHandshake(prologue []byte, ephemeralKey, staticKey, clientEphemeralKey [32]byte, sessionID string) (*HandshakeResult, error) {
+	ephemeralPublicKey, err := curve25519.X25519(ephemeralKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	staticPublicKey, err := curve25519.X25519(staticKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	ee, err := ComputeSharedSecret(ephemeralKey, clientEphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	es, err := ComputeSharedSecret(staticKey, clientEphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	return completeHandshake(prologue, clientEphemeralKey[:], ephemeralPublicKey, staticPublicKey, ee[:], es[:], sessionID)
+}
+
+// completeHandshake проходит шаблон рукопожатия и выводит сессионный ключ.
+// Идентификатор сессии добавляется в стенограмму последним: сервер выдает его
+// в том же ответе, и подпись подтверждает, что сессия выдана этим сервером.
+func completeHandshake(prologue, clientEphemeralKey, serverEphemeralKey, serverStaticKey, ee, es []byte, sessionID string) (*HandshakeResult, error) {
+	state := newHandshakeState()
+	if prologue != nil {
+		state.mixHash(prologue)
+	}
+	state.mixHash(clientEphemeralKey)
+	state.mixHash(serverEphemeralKey)
+	if err := state.mixKey(ee); err != nil {
+		return nil, err
+	}
+	state.mixHash(serverStaticKey)
+	if err := state.mixKey(es); err != nil {
+		return nil, err
+	}
+	state.mixHash([]byte(sessionID))
+
+	sessionKey, err := deriveKey(state.chainingKey, state.hash, []byte("SessionKey"), 32)
+	if err != nil {
+		return nil, err
+	}
+	return &HandshakeResult{SessionKey: sessionKey, Hash: state.hash}, nil
+}
@@ -0,0 +1,165 @@
+package cryptography
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// handshakeVector — эталонное рукопожатие из testdata/handshake_vectors.json.
+// Все значения записаны в hex. Пустой Prologue означает рукопожатие без пролога.
+type handshakeVector struct {
+	Prologue                  string `json:",omitempty"`
+	ClientEphemeralPrivateKey string
+	ClientEphemeralPublicKey  string
+	ServerEphemeralPrivateKey string
+	ServerEphemeralPublicKey  string
+	ServerStaticPrivateKey    string
+	ServerStaticPublicKey     string
+	SessionID                 string
+	Hash                      string
+	SessionKey                string
+	AccessKey                 string
+}
+
+func loadHandshakeVectors(t *testing.T) []handshakeVector {
+	t.Helper()
+	data, err := os.ReadFile("testdata/handshake_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []handshakeVector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("no handshake vectors")
+	}
+	return vectors
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func decodeKey(t *testing.T, s string) [32]byte {
+	t.Helper()
+	b := decodeHex(t, s)
+	if len(b) != 32 {
+		t.Fatalf("key %s has length %d, want 32", s, len(b))
+	}
+	return [32]byte(b)
+}
+
+func TestHandshakeVectors(t *testing.T) {
+	for i, vector := range loadHandshakeVectors(t) {
+		t.Run(fmt.Sprintf("Vector%d", i), func(t *testing.T) {
+			var prologue []byte
+			if vector.Prologue != "" {
+				prologue = decodeHex(t, vector.Prologue)
+			}
+			clientEphemeralKey := decodeKey(t, vector.ClientEphemeralPrivateKey)
+			clientEphemeralPublicKey := decodeKey(t, vector.ClientEphemeralPublicKey)
+			serverEphemeralKey := decodeKey(t, vector.ServerEphemeralPrivateKey)
+			serverEphemeralPublicKey := decodeKey(t, vector.ServerEphemeralPublicKey)
+			serverStaticKey := decodeKey(t, vector.ServerStaticPrivateKey)
+			serverStaticPublicKey := decodeKey(t, vector.ServerStaticPublicKey)
+
+			for _, pair := range []struct{ private, public [32]byte }{
+				{clientEphemeralKey, clientEphemeralPublicKey},
+				{serverEphemeralKey, serverEphemeralPublicKey},
+				{serverStaticKey, serverStaticPublicKey},
+			} {
+				public, err := curve25519.X25519(pair.private[:], curve25519.Basepoint)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(public, pair.public[:]) {
+					t.Fatalf("public key %x does not match its private key", pair.public)
+				}
+			}
+
+			client, err := ClientHandshake(prologue, clientEphemeralKey, serverEphemeralPublicKey, serverStaticPublicKey, vector.SessionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server, err := ServerHandshake(prologue, serverEphemeralKey, serverStaticKey, clientEphemeralPublicKey, vector.SessionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, side := range []struct {
+				name   string
+				result *HandshakeResult
+			}{{"client", client}, {"server", server}} {
+				if got := hex.EncodeToString(side.result.Hash); got != vector.Hash {
+					t.Errorf("%s transcript hash is %s, want %s", side.name, got, vector.Hash)
+				}
+				if got := hex.EncodeToString(side.result.SessionKey); got != vector.SessionKey {
+					t.Errorf("%s session key is %s, want %s", side.name, got, vector.SessionKey)
+				}
+				accessKey, err := GenerateAccessKey(side.result.SessionKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := hex.EncodeToString(accessKey); got != vector.AccessKey {
+					t.Errorf("%s access key is %s, want %s", side.name, got, vector.AccessKey)
+				}
+			}
+		})
+	}
+}
+
+func TestHandshakeTranscriptBinding(t *testing.T) {
+	vector := loadHandshakeVectors(t)[0]
+	clientEphemeralKey := decodeKey(t, vector.ClientEphemeralPrivateKey)
+	serverEphemeralPublicKey := decodeKey(t, vector.ServerEphemeralPublicKey)
+	serverStaticPublicKey := decodeKey(t, vector.ServerStaticPublicKey)
+
+	base, err := ClientHandshake(nil, clientEphemeralKey, serverEphemeralPublicKey, serverStaticPublicKey, vector.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Любое изменение входных данных рукопожатия должно менять и хеш, и ключ.
+	tests := []struct {
+		name      string
+		prologue  []byte
+		sessionID string
+	}{
+		{"EmptyPrologue", []byte{}, vector.SessionID},
+		{"Prologue", NegotiationPrologue([]CipherSuite{AES256GCM}), vector.SessionID},
+		{"SessionID", nil, vector.SessionID + "0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := ClientHandshake(test.prologue, clientEphemeralKey, serverEphemeralPublicKey, serverStaticPublicKey, test.sessionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(result.Hash, base.Hash) || bytes.Equal(result.SessionKey, base.SessionKey) {
+				t.Fatal("handshake result does not depend on the changed input")
+			}
+		})
+	}
+}
+
+func TestHandshakeRejectsLowOrderPoint(t *testing.T) {
+	vector := loadHandshakeVectors(t)[0]
+	clientEphemeralKey := decodeKey(t, vector.ClientEphemeralPrivateKey)
+	serverStaticPublicKey := decodeKey(t, vector.ServerStaticPublicKey)
+
+	if _, err := ClientHandshake(nil, clientEphemeralKey, [32]byte{}, serverStaticPublicKey, vector.SessionID); err == nil {
+		t.Fatal("handshake with a zero server ephemeral key succeeded")
+	}
+}
@@ -32,6 +32,17 @@ func GenerateAccessKey(sessionKey []byte) ([]byte, error) {
 	return deriveKey(sessionKey, nil, []byte("AccessKey"), 32)
 }
 
+// RefreshAccessKey генерирует новый ключ доступа на основе текущего ключа и случайного nonce.
+// Позволяет обновить ключ сессии без повторного обмена ключами.
+func RefreshAccessKey(accessKey, nonce []byte) ([]byte, error) {
+	return deriveKey(accessKey, nonce, []byte("RefreshAccessKey"), 32)
+}
+
+// GenerateKeyEncryptionKey генерирует ключ для шифрования хранимых ключей на основе секрета.
+func GenerateKeyEncryptionKey(secret []byte) ([]byte, error) {
+	return deriveKey(secret, nil, []byte("KeyEncryptionKey"), 32)
+}
+
 // ComputeEAPI вычисляет HMAC-SHA256 на основе ключа доступа и временной метки.
 func ComputeEAPI(accessKey []byte, timestamp int64) []byte {
 	h := hmac.New(sha256.New, accessKey)
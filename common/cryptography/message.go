@@ -0,0 +1,122 @@
+package cryptography
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// messageDomain отделяет дополнительные данные сообщений сессии от других данных,
+// защищенных теми же ключами.
+const messageDomain = "cu/message/v1"
+
+// commitmentSize — длина обязательства ключа в начале шифротекста сообщения.
+const commitmentSize = 32
+
+// Direction — направление сообщения сессии. У каждого направления свой ключ,
+// поэтому ответ сервера нельзя отправить серверу обратно как запрос клиента.
+type Direction byte
+
+// Направления сообщений.
+const (
+	ClientToServer Direction = 1
+	ServerToClient Direction = 2
+)
+
+// String возвращает название направления.
+func (d Direction) String() string {
+	switch d {
+	case ClientToServer:
+		return "client-to-server"
+	case ServerToClient:
+		return "server-to-client"
+	}
+	return fmt.Sprintf("direction(%d)", byte(d))
+}
+
+// Типы сообщений сессии. Тип не позволяет переслать сообщение из HTTP-запроса в туннель и наоборот.
+const (
+	MessageAction = "action"
+	MessageTunnel = "tunnel"
+)
+
+// MessageHeader описывает сообщение сессии. Заголовок не передается вместе
+// с сообщением: обе стороны знают его заранее и привязывают к шифротексту
+// как дополнительные данные.
+type MessageHeader struct {
+	SessionID string
+	Direction Direction
+	Type      string
+	// Sequence — порядковый номер сообщения в своем направлении.
+	Sequence uint64
+}
+
+// additionalData кодирует заголовок. Поля переменной длины предваряются длиной.
+func (h MessageHeader) additionalData() []byte {
+	data := []byte(messageDomain)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(h.SessionID)))
+	data = append(data, h.SessionID...)
+	data = append(data, byte(h.Direction))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(h.Type)))
+	data = append(data, h.Type...)
+	return binary.BigEndian.AppendUint64(data, h.Sequence)
+}
+
+// messageKeys выводит из ключа доступа ключ шифрования набора suite для направления
+// direction и обязательство этого ключа. Для AES256GCM название набора не входит
+// в info, чтобы ключи совпадали с ключами сессий, созданных до выбора наборов.
+func messageKeys(accessKey []byte, suite CipherSuite, direction Direction) (encryptionKey, commitment []byte, err error) {
+	switch direction {
+	case ClientToServer, ServerToClient:
+	default:
+		return nil, nil, fmt.Errorf("invalid message direction %d", byte(direction))
+	}
+	if !suite.Supported() {
+		return nil, nil, fmt.Errorf("unsupported cipher suite %q", string(suite))
+	}
+
+	info := "MessageKey/" + direction.String()
+	if suite != AES256GCM {
+		info += "/" + string(suite)
+	}
+	keys, err := deriveKey(accessKey, nil, []byte(info), 32+commitmentSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error deriving message key: %w", err)
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// SealMessage шифрует сообщение сессии набором suite ключом направления, выведенным
+// из ключа доступа accessKey, и привязывает к шифротексту заголовок header.
+// Шифротекст начинается с обязательства ключа: ни AES-GCM, ни XChaCha20-Poly1305
+// сами по себе не гарантируют, что шифротекст расшифровывается только одним ключом.
+func SealMessage(plainText, accessKey []byte, suite CipherSuite, header MessageHeader) ([]byte, error) {
+	encryptionKey, commitment, err := messageKeys(accessKey, suite, header.Direction)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := suite.Seal(plainText, encryptionKey, header.additionalData())
+	if err != nil {
+		return nil, err
+	}
+	return append(commitment, sealed...), nil
+}
+
+// OpenMessage расшифровывает сообщение, полученное от SealMessage.
+// Набор suite и заголовок header должны совпадать с переданными при шифровании.
+func OpenMessage(cipherText, accessKey []byte, suite CipherSuite, header MessageHeader) ([]byte, error) {
+	encryptionKey, commitment, err := messageKeys(accessKey, suite, header.Direction)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cipherText) < commitmentSize {
+		return nil, errors.New("ciphertext too short")
+	}
+	if subtle.ConstantTimeCompare(cipherText[:commitmentSize], commitment) != 1 {
+		return nil, errors.New("error decrypting message: key commitment mismatch")
+	}
+	return suite.Open(cipherText[commitmentSize:], encryptionKey, header.additionalData())
+}
@@ -0,0 +1,257 @@
+package cryptography
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Потоковое шифрование по схеме STREAM (Hoang, Reyhanitabar, Rogaway, Vizár)
+// для данных, которые не стоит держать в памяти целиком: сохранений, повторов, наборов ресурсов.
+//
+// Формат потока: байт версии, соль длиной streamSaltSize и фрагменты AES-GCM.
+// Из ключа и соли выводится ключ потока, поэтому один ключ можно использовать
+// для многих потоков. Каждый фрагмент, кроме последнего, содержит ровно StreamChunkSize
+// байт открытого текста. Nonce фрагмента — его номер и флаг последнего фрагмента,
+// поэтому перестановка, удаление и дублирование фрагментов, а также обрезка потока
+// обнаруживаются при расшифровке.
+const (
+	streamVersion  = 1
+	streamSaltSize = 32
+	streamTagSize  = 16
+
+	// StreamChunkSize — размер открытого текста во фрагменте потока.
+	StreamChunkSize = 64 << 10
+
+	streamEncryptedChunkSize = StreamChunkSize + streamTagSize
+)
+
+var (
+	// ErrStreamTruncated возвращается, если поток оборвался до последнего фрагмента.
+	ErrStreamTruncated = errors.New("encrypted stream is truncated")
+	// ErrStreamClosed возвращается при записи в закрытый поток.
+	ErrStreamClosed = errors.New("encrypted stream is closed")
+)
+
+// streamWriter шифрует записанные данные фрагментами.
+type streamWriter struct {
+	w              io.Writer
+	aead           cipher.AEAD
+	additionalData []byte
+
+	plainText  []byte
+	cipherText []byte
+	counter    uint64
+	closed     bool
+	err        error
+}
+
+// NewStreamWriter возвращает писатель, который шифрует данные ключом key
+// и записывает поток в w. Дополнительные данные additionalData привязываются
+// к каждому фрагменту. Close записывает последний фрагмент и обязателен:
+// без него поток считается обрезанным. Close не закрывает w.
+func NewStreamWriter(w io.Writer, key, additionalData []byte) (io.WriteCloser, error) {
+	header := make([]byte, 1+streamSaltSize)
+	header[0] = streamVersion
+	if _, err := io.ReadFull(rand.Reader, header[1:]); err != nil {
+		return nil, fmt.Errorf("error generating stream salt: %w", err)
+	}
+
+	aead, err := newStreamAEAD(key, header[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("error writing stream header: %w", err)
+	}
+
+	return &streamWriter{
+		w:              w,
+		aead:           aead,
+		additionalData: additionalData,
+		plainText:      make([]byte, 0, StreamChunkSize),
+		cipherText:     make([]byte, 0, streamEncryptedChunkSize),
+	}, nil
+}
+
+// Write шифрует p. Полный фрагмент записывается, только когда за ним появляются
+// новые данные: до Close неизвестно, будет ли он последним.
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, ErrStreamClosed
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(s.plainText) == StreamChunkSize {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(s.plainText[len(s.plainText):StreamChunkSize], p)
+		s.plainText = s.plainText[:len(s.plainText)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close записывает последний фрагмент потока.
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.err != nil {
+		return s.err
+	}
+	return s.flush(true)
+}
+
+// flush шифрует накопленный открытый текст и записывает фрагмент.
+// Ошибка записи запоминается: после нее поток уже не восстановить.
+func (s *streamWriter) flush(last bool) error {
+	s.cipherText = s.aead.Seal(s.cipherText[:0], streamNonce(s.counter, last), s.plainText, s.additionalData)
+	if _, err := s.w.Write(s.cipherText); err != nil {
+		s.err = fmt.Errorf("error writing stream chunk: %w", err)
+		return s.err
+	}
+
+	s.counter++
+	s.plainText = s.plainText[:0]
+	return nil
+}
+
+// streamReader расшифровывает поток фрагмент за фрагментом.
+type streamReader struct {
+	r              io.Reader
+	aead           cipher.AEAD
+	additionalData []byte
+
+	// cipherText вмещает фрагмент и еще один байт: по нему видно, что фрагмент не последний.
+	cipherText []byte
+	buffered   int
+	plainText  []byte
+	unread     []byte
+	counter    uint64
+	done       bool
+	err        error
+}
+
+// NewStreamReader читает заголовок потока из r и возвращает читателя,
+// который расшифровывает поток ключом key. Дополнительные данные additionalData
+// должны совпадать с переданными в NewStreamWriter. Read возвращает данные
+// только после проверки подлинности их фрагмента; если поток обрезан,
+// Read возвращает ErrStreamTruncated вместо io.EOF.
+func NewStreamReader(r io.Reader, key, additionalData []byte) (io.Reader, error) {
+	header := make([]byte, 1+streamSaltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrStreamTruncated
+		}
+		return nil, fmt.Errorf("error reading stream header: %w", err)
+	}
+	if header[0] != streamVersion {
+		return nil, fmt.Errorf("unsupported stream version %d", header[0])
+	}
+
+	aead, err := newStreamAEAD(key, header[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader{
+		r:              r,
+		aead:           aead,
+		additionalData: additionalData,
+		cipherText:     make([]byte, streamEncryptedChunkSize+1),
+		plainText:      make([]byte, 0, StreamChunkSize),
+	}, nil
+}
+
+// Read возвращает расшифрованные данные.
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.unread) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.err = s.readChunk()
+	}
+
+	n := copy(p, s.unread)
+	s.unread = s.unread[n:]
+	return n, nil
+}
+
+// readChunk читает и расшифровывает следующий фрагмент.
+func (s *streamReader) readChunk() error {
+	n, err := io.ReadFull(s.r, s.cipherText[s.buffered:])
+	n += s.buffered
+	last := false
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		last = true
+	default:
+		return fmt.Errorf("error reading stream chunk: %w", err)
+	}
+
+	chunk := s.cipherText[:n]
+	if !last {
+		chunk = s.cipherText[:streamEncryptedChunkSize]
+	}
+	if len(chunk) < streamTagSize {
+		return ErrStreamTruncated
+	}
+
+	plainText, err := s.aead.Open(s.plainText[:0], streamNonce(s.counter, last), chunk, s.additionalData)
+	if err != nil {
+		// Полный фрагмент в конце потока, который открывается как промежуточный,
+		// означает, что последние фрагменты отрезаны.
+		if last && len(chunk) == streamEncryptedChunkSize {
+			if _, err := s.aead.Open(s.plainText[:0], streamNonce(s.counter, false), chunk, s.additionalData); err == nil {
+				return ErrStreamTruncated
+			}
+		}
+		return fmt.Errorf("error decrypting stream chunk %d: %w", s.counter, err)
+	}
+
+	if !last {
+		s.cipherText[0] = s.cipherText[streamEncryptedChunkSize]
+		s.buffered = 1
+	}
+	s.counter++
+	s.unread = plainText
+	s.done = last
+	return nil
+}
+
+// newStreamAEAD создает AES-GCM с ключом потока, выведенным из key и соли salt.
+func newStreamAEAD(key, salt []byte) (cipher.AEAD, error) {
+	streamKey, err := deriveKey(key, salt, []byte("StreamKey"), 32)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving stream key: %w", err)
+	}
+	return newGCM(streamKey)
+}
+
+// streamNonce составляет nonce фрагмента из его номера и флага последнего фрагмента.
+func streamNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
@@ -0,0 +1,196 @@
+package cryptography
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// streamHeaderSize — длина заголовка потока: байт версии и соль.
+const streamHeaderSize = 1 + streamSaltSize
+
+// sealStream шифрует data потоком, записывая его частями длиной split.
+func sealStream(t testing.TB, key, additionalData, data []byte, split int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewStreamWriter(&buf, key, additionalData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	split = max(split, 1)
+	for p := data; len(p) > 0; {
+		n := min(split, len(p))
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// openStream расшифровывает поток, читая его по одному байту,
+// чтобы проверить и границы фрагментов, и короткие чтения.
+func openStream(cipherText, key, additionalData []byte) ([]byte, error) {
+	r, err := NewStreamReader(bytes.NewReader(cipherText), key, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(iotest.OneByteReader(r))
+}
+
+// streamChunk возвращает границы фрагмента i в потоке.
+func streamChunk(i int) (int, int) {
+	start := streamHeaderSize + i*streamEncryptedChunkSize
+	return start, start + streamEncryptedChunkSize
+}
+
+func TestStreamChunkBoundaries(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	tests := []struct {
+		name   string
+		size   int
+		chunks int
+	}{
+		{"Empty", 0, 1},
+		{"OneByte", 1, 1},
+		{"OneChunk", StreamChunkSize, 1},
+		{"OneChunkPlusOne", StreamChunkSize + 1, 2},
+		{"TwoChunks", 2 * StreamChunkSize, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := make([]byte, test.size)
+			for i := range data {
+				data[i] = byte(i)
+			}
+
+			for _, split := range []int{1 << 10, StreamChunkSize, test.size} {
+				cipherText := sealStream(t, key, []byte("ad"), data, split)
+				if want := streamHeaderSize + test.size + test.chunks*streamTagSize; len(cipherText) != want {
+					t.Fatalf("stream length is %d, want %d", len(cipherText), want)
+				}
+				plainText, err := openStream(cipherText, key, []byte("ad"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(plainText, data) {
+					t.Fatal("decrypted stream differs from the original")
+				}
+			}
+		})
+	}
+}
+
+func TestStreamTruncation(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	cipherText := sealStream(t, key, nil, make([]byte, 2*StreamChunkSize+1), StreamChunkSize)
+
+	// Обрезка по границе фрагмента не ломает ни один фрагмент,
+	// поэтому обнаруживается только по отсутствию последнего.
+	for _, cut := range []int{0, 1, streamHeaderSize, streamHeaderSize + streamEncryptedChunkSize, streamHeaderSize + 2*streamEncryptedChunkSize} {
+		if _, err := openStream(cipherText[:cut], key, nil); !errors.Is(err, ErrStreamTruncated) {
+			t.Errorf("stream cut at %d: got %v, want ErrStreamTruncated", cut, err)
+		}
+	}
+	if _, err := openStream(cipherText[:len(cipherText)-1], key, nil); err == nil {
+		t.Error("stream without its last byte was accepted")
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	cipherText := sealStream(t, key, []byte("ad"), make([]byte, 3*StreamChunkSize), StreamChunkSize)
+	firstStart, firstEnd := streamChunk(0)
+	_, secondEnd := streamChunk(1)
+	first, second := cipherText[firstStart:firstEnd], cipherText[firstEnd:secondEnd]
+
+	tests := []struct {
+		name           string
+		cipherText     []byte
+		key            []byte
+		additionalData []byte
+	}{
+		{"WrongKey", cipherText, bytes.Repeat([]byte{8}, 32), []byte("ad")},
+		{"WrongAdditionalData", cipherText, key, []byte("other")},
+		{"SwappedChunks", join(cipherText[:firstStart], second, first, cipherText[secondEnd:]), key, []byte("ad")},
+		{"DroppedChunk", join(cipherText[:firstEnd], cipherText[secondEnd:]), key, []byte("ad")},
+		{"DuplicatedChunk", join(cipherText[:firstEnd], first, cipherText[firstEnd:]), key, []byte("ad")},
+		{"UnknownVersion", join([]byte{streamVersion + 1}, cipherText[1:]), key, []byte("ad")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := openStream(test.cipherText, test.key, test.additionalData); err == nil {
+				t.Fatal("tampered stream was accepted")
+			}
+		})
+	}
+}
+
+func TestStreamWriteAfterClose(t *testing.T) {
+	w, err := NewStreamWriter(io.Discard, make([]byte, 32), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); !errors.Is(err, ErrStreamClosed) {
+		t.Fatalf("Write after Close returned %v, want ErrStreamClosed", err)
+	}
+}
+
+// FuzzStream проверяет, что поток расшифровывается в исходные данные
+// и что обрезка, перестановка фрагментов и изменение любого бита обнаруживаются.
+// Параметр chunks добавляет перед data полные фрагменты, чтобы было что переставлять.
+func FuzzStream(f *testing.F) {
+	f.Add([]byte("hello"), uint8(0), 3, 0, 0, byte(1))
+	f.Add([]byte{}, uint8(1), 1000, 10, streamHeaderSize, byte(0x80))
+	f.Add([]byte("tail"), uint8(2), StreamChunkSize, streamHeaderSize+streamEncryptedChunkSize, -1, byte(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, chunks uint8, split, cut, flip int, mask byte) {
+		key := bytes.Repeat([]byte{7}, 32)
+		plainText := append(bytes.Repeat([]byte{chunks}, int(chunks%3)*StreamChunkSize), data...)
+		cipherText := sealStream(t, key, nil, plainText, split)
+
+		decrypted, err := openStream(cipherText, key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, plainText) {
+			t.Fatal("decrypted stream differs from the original")
+		}
+
+		if cut >= 0 {
+			if _, err := openStream(cipherText[:cut%len(cipherText)], key, nil); err == nil {
+				t.Fatal("truncated stream was accepted")
+			}
+		}
+
+		if mask != 0 && flip >= 0 {
+			tampered := bytes.Clone(cipherText)
+			tampered[flip%len(tampered)] ^= mask
+			if _, err := openStream(tampered, key, nil); err == nil {
+				t.Fatal("stream with a flipped bit was accepted")
+			}
+		}
+
+		if len(cipherText) >= streamHeaderSize+2*streamEncryptedChunkSize {
+			firstStart, firstEnd := streamChunk(0)
+			secondStart, secondEnd := streamChunk(1)
+			swapped := join(cipherText[:firstStart], cipherText[secondStart:secondEnd], cipherText[firstStart:firstEnd], cipherText[secondEnd:])
+			if _, err := openStream(swapped, key, nil); err == nil {
+				t.Fatal("stream with swapped chunks was accepted")
+			}
+		}
+	})
+}
+
+// join склеивает части в новый срез.
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
@@ -0,0 +1,120 @@
+package cryptography
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherSuite — алгоритм AEAD, которым шифруются сообщения сессии.
+// Набор выбирается при обмене ключами, см. NegotiateCipherSuite.
+type CipherSuite string
+
+// Поддерживаемые наборы.
+const (
+	// AES256GCM — AES-256-GCM со случайным 96-битным nonce. Быстр при аппаратной
+	// поддержке AES, но вероятность повтора nonce ограничивает число сообщений на одном ключе.
+	AES256GCM CipherSuite = "AES-256-GCM"
+	// XChaCha20Poly1305 — XChaCha20-Poly1305 со случайным 192-битным nonce.
+	// Повтор nonce практически исключен, и без аппаратного AES, например в WebAssembly,
+	// он быстрее AES-GCM.
+	XChaCha20Poly1305 CipherSuite = "XChaCha20-Poly1305"
+)
+
+// ErrNoCommonCipherSuite возвращается, если ни один из предложенных наборов не поддерживается.
+var ErrNoCommonCipherSuite = errors.New("no common cipher suite")
+
+// Supported сообщает, поддерживается ли набор.
+func (s CipherSuite) Supported() bool {
+	return s == AES256GCM || s == XChaCha20Poly1305
+}
+
+// newAEAD создает AEAD набора с ключом key длиной 32 байта.
+func (s CipherSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch s {
+	case AES256GCM:
+		return newGCM(key)
+	case XChaCha20Poly1305:
+		aead, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, fmt.Errorf("error creating XChaCha20-Poly1305: %w", err)
+		}
+		return aead, nil
+	}
+	return nil, fmt.Errorf("unsupported cipher suite %q", string(s))
+}
+
+// Seal шифрует данные алгоритмом набора со случайным nonce.
+// Дополнительные данные additionalData не шифруются, но защищаются от подмены.
+// Возвращает nonce, за которым следуют данные и тег.
+func (s CipherSuite) Seal(plainText, key, additionalData []byte) ([]byte, error) {
+	aead, err := s.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return sealAEAD(aead, plainText, additionalData)
+}
+
+// Open расшифровывает шифротекст, полученный от Seal того же набора.
+func (s CipherSuite) Open(cipherText, key, additionalData []byte) ([]byte, error) {
+	aead, err := s.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return openAEAD(aead, cipherText, additionalData)
+}
+
+// NegotiateCipherSuite выбирает первый поддерживаемый набор из предложенных клиентом
+// в порядке его предпочтения.
+func NegotiateCipherSuite(offered []CipherSuite) (CipherSuite, error) {
+	for _, suite := range offered {
+		if suite.Supported() {
+			return suite, nil
+		}
+	}
+	return "", ErrNoCommonCipherSuite
+}
+
+// NegotiationPrologue кодирует предложенные клиентом наборы для рукопожатия.
+// Пролог входит в подписанную стенограмму, поэтому посредник не может незаметно
+// убрать наборы из предложения клиента.
+func NegotiationPrologue(offered []CipherSuite) []byte {
+	var prologue []byte
+	for _, suite := range offered {
+		prologue = binary.BigEndian.AppendUint32(prologue, uint32(len(suite)))
+		prologue = append(prologue, suite...)
+	}
+	return prologue
+}
+
+// sealAEAD шифрует данные алгоритмом aead со случайным nonce и возвращает nonce,
+// за которым следуют данные и тег.
+func sealAEAD(aead cipher.AEAD, plainText, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plainText)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, plainText, additionalData), nil
+}
+
+// openAEAD расшифровывает шифротекст, полученный от sealAEAD.
+func openAEAD(aead cipher.AEAD, cipherText, additionalData []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(cipherText) < nonceSize {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, cipherText := cipherText[:nonceSize], cipherText[nonceSize:]
+	plainText, err := aead.Open(nil, nonce, cipherText, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting message: %w", err)
+	}
+
+	return plainText, nil
+}
@@ -0,0 +1,102 @@
+package cryptography
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+var cipherSuites = []CipherSuite{AES256GCM, XChaCha20Poly1305}
+
+// benchmarkSizes — размеры сообщений в бенчмарках: действие, состояние комнаты, крупный пакет.
+var benchmarkSizes = []int{64, 1 << 10, 16 << 10}
+
+func TestCipherSuiteRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, suite := range cipherSuites {
+		t.Run(string(suite), func(t *testing.T) {
+			cipherText, err := suite.Seal([]byte("message"), key, []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plainText, err := suite.Open(cipherText, key, []byte("ad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(plainText) != "message" {
+				t.Fatalf("Open returned %q, want %q", plainText, "message")
+			}
+			if _, err := suite.Open(cipherText, key, []byte("other")); err == nil {
+				t.Fatal("Open accepted other additional data")
+			}
+			for _, other := range cipherSuites {
+				if other == suite {
+					continue
+				}
+				if _, err := other.Open(cipherText, key, []byte("ad")); err == nil {
+					t.Fatalf("%s opened a %s ciphertext", other, suite)
+				}
+			}
+		})
+	}
+}
+
+func TestNegotiateCipherSuite(t *testing.T) {
+	tests := []struct {
+		offered []CipherSuite
+		want    CipherSuite
+		wantErr error
+	}{
+		{[]CipherSuite{XChaCha20Poly1305, AES256GCM}, XChaCha20Poly1305, nil},
+		{[]CipherSuite{"ROT13", AES256GCM}, AES256GCM, nil},
+		{[]CipherSuite{"ROT13"}, "", ErrNoCommonCipherSuite},
+		{nil, "", ErrNoCommonCipherSuite},
+	}
+	for _, test := range tests {
+		got, err := NegotiateCipherSuite(test.offered)
+		if got != test.want || !errors.Is(err, test.wantErr) {
+			t.Errorf("NegotiateCipherSuite(%q) = %q, %v; want %q, %v", test.offered, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+// Бенчмарки сравнивают наборы на целевой платформе. В WebAssembly они запускаются так:
+//
+//	PATH=$PATH:$(go env GOROOT)/lib/wasm GOOS=js GOARCH=wasm go test -run '^$' -bench . ./cryptography
+func BenchmarkSeal(b *testing.B) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, suite := range cipherSuites {
+		for _, size := range benchmarkSizes {
+			plainText := make([]byte, size)
+			b.Run(fmt.Sprintf("%s/%d", suite, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for range b.N {
+					if _, err := suite.Seal(plainText, key, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, suite := range cipherSuites {
+		for _, size := range benchmarkSizes {
+			cipherText, err := suite.Seal(make([]byte, size), key, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("%s/%d", suite, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for range b.N {
+					if _, err := suite.Open(cipherText, key, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
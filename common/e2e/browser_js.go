@@ -0,0 +1,125 @@
+//go:build js
+
+package e2e
+
+import (
+	"cu/common/cryptography"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"syscall/js"
+)
+
+// LocalStorage хранит сессию в localStorage браузера.
+type LocalStorage struct{}
+
+// NewLocalStorage создает хранилище сессии в localStorage браузера.
+func NewLocalStorage() *LocalStorage {
+	return &LocalStorage{}
+}
+
+// Load читает сессию из localStorage.
+func (LocalStorage) Load() (*SavedSession, error) {
+	localStorage := js.Global().Get("localStorage")
+	sessionIDVal := localStorage.Call("getItem", "SessionID")
+	if sessionIDVal.Type() != js.TypeString {
+		return nil, ErrNoSession
+	}
+	accessKeyHexVal := localStorage.Call("getItem", "AccessKey")
+	if accessKeyHexVal.Type() != js.TypeString {
+		return nil, ErrNoSession
+	}
+
+	accessKey, err := hex.DecodeString(accessKeyHexVal.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode AccessKey: %w", err)
+	}
+
+	session := &SavedSession{
+		SessionID: sessionIDVal.String(),
+		AccessKey: accessKey,
+	}
+	if keyIDVal := localStorage.Call("getItem", "KeyID"); keyIDVal.Type() == js.TypeString {
+		session.KeyID = keyIDVal.String()
+	}
+	if sequenceVal := localStorage.Call("getItem", "Sequence"); sequenceVal.Type() == js.TypeString {
+		session.Sequence, _ = strconv.ParseUint(sequenceVal.String(), 10, 64)
+	}
+	if versionVal := localStorage.Call("getItem", "ProtocolVersion"); versionVal.Type() == js.TypeString {
+		session.Version, _ = strconv.Atoi(versionVal.String())
+	}
+	if suiteVal := localStorage.Call("getItem", "CipherSuite"); suiteVal.Type() == js.TypeString {
+		session.CipherSuite = cryptography.CipherSuite(suiteVal.String())
+	}
+	return session, nil
+}
+
+// Save записывает сессию в localStorage.
+func (LocalStorage) Save(session *SavedSession) error {
+	localStorage := js.Global().Get("localStorage")
+	localStorage.Call("setItem", "SessionID", session.SessionID)
+	localStorage.Call("setItem", "KeyID", session.KeyID)
+	localStorage.Call("setItem", "AccessKey", hex.EncodeToString(session.AccessKey))
+	localStorage.Call("setItem", "Sequence", strconv.FormatUint(session.Sequence, 10))
+	localStorage.Call("setItem", "ProtocolVersion", strconv.Itoa(session.Version))
+	localStorage.Call("setItem", "CipherSuite", string(session.CipherSuite))
+	return nil
+}
+
+// Clear удаляет сессию из localStorage.
+func (LocalStorage) Clear() error {
+	localStorage := js.Global().Get("localStorage")
+	localStorage.Call("removeItem", "SessionID")
+	localStorage.Call("removeItem", "KeyID")
+	localStorage.Call("removeItem", "AccessKey")
+	localStorage.Call("removeItem", "Sequence")
+	localStorage.Call("removeItem", "ProtocolVersion")
+	localStorage.Call("removeItem", "CipherSuite")
+	return nil
+}
+
+// defaultSessionStore возвращает хранилище сессии по умолчанию: localStorage браузера.
+func defaultSessionStore() SessionStore {
+	return NewLocalStorage()
+}
+
+// defaultCipherSuites возвращает наборы шифров, которые клиент предлагает по умолчанию.
+// В WebAssembly нет аппаратного AES, и XChaCha20-Poly1305 быстрее AES-GCM.
+func defaultCipherSuites() []cryptography.CipherSuite {
+	return []cryptography.CipherSuite{cryptography.XChaCha20Poly1305, cryptography.AES256GCM}
+}
+
+// ServerURLFromWindow возвращает адрес, с которого загружена страница.
+func ServerURLFromWindow() string {
+	origin := js.Global().Get("location").Get("origin")
+	if origin.Type() != js.TypeString {
+		return ""
+	}
+	return origin.String()
+}
+
+// RoomIDFromWindow возвращает идентификатор комнаты, переданный странице через window.roomID.
+func RoomIDFromWindow() string {
+	roomID := js.Global().Get("roomID")
+	if roomID.Type() != js.TypeString {
+		return ""
+	}
+	return roomID.String()
+}
+
+// TelegramInitDataFromWindow возвращает initData Telegram WebApp, если игра открыта внутри Telegram.
+func TelegramInitDataFromWindow() string {
+	telegram := js.Global().Get("Telegram")
+	if telegram.Type() != js.TypeObject {
+		return ""
+	}
+	webApp := telegram.Get("WebApp")
+	if webApp.Type() != js.TypeObject {
+		return ""
+	}
+	initData := webApp.Get("initData")
+	if initData.Type() != js.TypeString {
+		return ""
+	}
+	return initData.String()
+}
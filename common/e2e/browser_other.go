@@ -0,0 +1,32 @@
+//go:build !js
+
+package e2e
+
+import "cu/common/cryptography"
+
+// defaultSessionStore возвращает хранилище сессии по умолчанию.
+// Вне браузера сессия по умолчанию хранится только в памяти.
+func defaultSessionStore() SessionStore {
+	return NewMemoryStore()
+}
+
+// defaultCipherSuites возвращает наборы шифров, которые клиент предлагает по умолчанию.
+// Вне браузера обычно есть аппаратный AES, и AES-GCM быстрее.
+func defaultCipherSuites() []cryptography.CipherSuite {
+	return []cryptography.CipherSuite{cryptography.AES256GCM, cryptography.XChaCha20Poly1305}
+}
+
+// ServerURLFromWindow вне браузера всегда возвращает пустую строку.
+func ServerURLFromWindow() string {
+	return ""
+}
+
+// RoomIDFromWindow вне браузера всегда возвращает пустую строку.
+func RoomIDFromWindow() string {
+	return ""
+}
+
+// TelegramInitDataFromWindow вне браузера всегда возвращает пустую строку.
+func TelegramInitDataFromWindow() string {
+	return ""
+}
@@ -1,120 +1,339 @@
 package e2e
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"cu/common/cryptography"
+	"cu/common/protocol"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"net/url"
-	"syscall/js"
+	"slices"
+	"strconv"
 	"time"
 )
 
+var (
+	// ErrSessionExpired возвращается, если сервер не принял сессию клиента:
+	// она истекла, была завершена или удалена. Требуется повторный обмен ключами.
+	ErrSessionExpired = errors.New("session expired")
+	// ErrRateLimited возвращается, если сервер продолжает отклонять запросы
+	// из-за превышения лимита после всех повторных попыток.
+	ErrRateLimited = errors.New("rate limited by server")
+	// ErrUntrustedServer возвращается, если подпись обмена ключами не подтверждена
+	// закрепленным ключом сервера или ключ не закреплен: ответ мог подменить посредник.
+	ErrUntrustedServer = errors.New("server handshake signature verification failed")
+)
+
+// pinnedServerKey — публичный ключ подписи сервера Ed25519 в виде hex-строки.
+// Встраивается при сборке: -ldflags "-X cu/common/e2e.pinnedServerKey=<ключ>",
+// значение выводит команда сервера keys identity.
+var pinnedServerKey string
+
+// insecureSkipServerVerify отключает проверку подписи обмена ключами, если равен "true".
+// Только для локальной разработки: -ldflags "-X cu/common/e2e.insecureSkipServerVerify=true".
+var insecureSkipServerVerify string
+
+// Повтор запросов, отклоненных сервером со статусом 429.
+const (
+	maxRateLimitRetries = 3
+	initialRetryDelay   = time.Second
+	// maxRetryDelay меньше окна EAPI, чтобы повторный запрос оставался действительным.
+	maxRetryDelay = 10 * time.Second
+)
+
 // Client представляет клиента для взаимодействия с сервером.
 type Client struct {
+	// PrivateKey и PublicKey — эфемерная пара ключей текущего обмена ключами.
+	// Она создается заново для каждого обмена, а приватный ключ стирается после него.
 	PrivateKey [32]byte
 	PublicKey  [32]byte
-	SharedKey  [32]byte
 	DerivedKey []byte
 	AccessKey  []byte
 	SessionID  string
+	KeyID      string
+	RoomID     string
+	InitData   string
 	ServerURL  string
+	Sequence   uint64
+	// Codec — формат конвертов, в котором клиент общается с сервером.
+	Codec protocol.Codec
+	// Store хранит сессию между запусками клиента.
+	Store SessionStore
+	// ServerIdentityKey — ключ подписи сервера, которым проверяется обмен ключами.
+	// Если он не задан, обмен ключами отклоняется с ErrUntrustedServer.
+	ServerIdentityKey ed25519.PublicKey
+	// InsecureSkipVerify разрешает обмен ключами без ключа подписи сервера.
+	// Такой обмен может перехватить посредник, поэтому флаг допустим только при разработке.
+	InsecureSkipVerify bool
+	// CipherSuites — наборы шифров, которые клиент предлагает при обмене ключами,
+	// в порядке предпочтения.
+	CipherSuites []cryptography.CipherSuite
+	// CipherSuite — набор шифров текущей сессии, выбранный сервером.
+	CipherSuite cryptography.CipherSuite
 }
 
 // NewClient создает новый клиент с указанным URL сервера.
+// В браузере сессия хранится в localStorage, в остальных средах — в памяти;
+// хранилище можно заменить через поле Store. Ключ подписи сервера берется
+// из встроенного при сборке pinnedServerKey, а InsecureSkipVerify —
+// из insecureSkipServerVerify.
 func NewClient(serverURL string) (*Client, error) {
-	privateKey, publicKey, err := cryptography.GenerateKeyPair()
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate client keys: %w", err)
+	var identityKey ed25519.PublicKey
+	if pinnedServerKey != "" {
+		var err error
+		identityKey, err = cryptography.ParseIdentityKey(pinnedServerKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pinned server key: %w", err)
+		}
 	}
 
 	return &Client{
-		PrivateKey: privateKey,
-		PublicKey:  publicKey,
-		ServerURL:  serverURL,
+		ServerIdentityKey:  identityKey,
+		InsecureSkipVerify: insecureSkipServerVerify == "true",
+		ServerURL:          serverURL,
+		Codec:              protocol.CBOR,
+		Store:              defaultSessionStore(),
+		CipherSuites:       defaultCipherSuites(),
 	}, nil
 }
 
-// LoadSessionFromLocalStorage загружает сессию из локального хранилища.
-func (c *Client) LoadSessionFromLocalStorage() bool {
-	localStorage := js.Global().Get("localStorage")
-	sessionIDVal := localStorage.Call("getItem", "SessionID")
-	if sessionIDVal.IsNull() || sessionIDVal.IsUndefined() {
+// LoadSession загружает сохраненную сессию из хранилища Store.
+// Возвращает false, если сессии нет, ее не удалось прочитать или она получена
+// по прежней версии протокола, сообщения которой клиент уже не шифрует.
+func (c *Client) LoadSession() bool {
+	session, err := c.Store.Load()
+	if err != nil {
+		if !errors.Is(err, ErrNoSession) {
+			log.Printf("failed to load session: %v", err)
+		}
 		return false
 	}
-	accessKeyHexVal := localStorage.Call("getItem", "AccessKey")
-	if accessKeyHexVal.IsNull() || accessKeyHexVal.IsUndefined() {
+	if session.Version != protocol.Version {
+		log.Printf("saved session uses protocol version %d, exchanging keys again", session.Version)
 		return false
 	}
 
-	accessKey, err := hex.DecodeString(accessKeyHexVal.String())
+	c.CipherSuite = session.CipherSuite
+	c.SessionID = session.SessionID
+	c.KeyID = session.KeyID
+	c.AccessKey = session.AccessKey
+	c.Sequence = session.Sequence
+	return true
+}
+
+// saveSession сохраняет сессию в хранилище Store.
+// Ошибка записывается в журнал: сессия продолжает работать, но не переживет перезапуск.
+func (c *Client) saveSession() {
+	err := c.Store.Save(&SavedSession{
+		Version:     protocol.Version,
+		CipherSuite: c.CipherSuite,
+		SessionID:   c.SessionID,
+		KeyID:       c.KeyID,
+		AccessKey:   c.AccessKey,
+		Sequence:    c.Sequence,
+	})
 	if err != nil {
-		log.Printf("failed to decode AccessKey: %v", err)
-		return false
+		log.Printf("failed to save session: %v", err)
 	}
+}
 
-	c.SessionID = sessionIDVal.String()
-	c.AccessKey = accessKey
+// ClearSession забывает текущую сессию и удаляет ее из хранилища Store.
+func (c *Client) ClearSession() {
+	c.SessionID = ""
+	c.AccessKey = nil
+	c.Sequence = 0
 
-	return true
+	if err := c.Store.Clear(); err != nil {
+		log.Printf("failed to clear session: %v", err)
+	}
 }
 
-// saveSessionToLocalStorage сохраняет сессию в локальное хранилище.
-func (c *Client) saveSessionToLocalStorage() {
-	localStorage := js.Global().Get("localStorage")
-	localStorage.Call("setItem", "SessionID", c.SessionID)
-	localStorage.Call("setItem", "AccessKey", hex.EncodeToString(c.AccessKey))
+// ExchangeKeysWithServer выполняет обмен ключами с сервером.
+func (c *Client) ExchangeKeysWithServer(ctx context.Context) error {
+	request, err := c.newKeyExchangeRequest()
+	if err != nil {
+		return err
+	}
+	var result protocol.KeyExchangeResponse
+	if err := c.call(ctx, "/key-exchange", request, &result, false); err != nil {
+		return fmt.Errorf("failed to exchange keys: %w", err)
+	}
+
+	return c.completeKeyExchange(&result)
 }
 
-// ExchangeKeysWithServer выполняет обмен ключами с сервером.
-func (c *Client) ExchangeKeysWithServer() error {
-	clientPublicKeyHex := hex.EncodeToString(c.PublicKey[:])
-	resp, err := http.PostForm(c.ServerURL+"/key-exchange", url.Values{
-		"ClientPublicKey": {clientPublicKeyHex},
-	})
+// newKeyExchangeRequest создает эфемерную пару ключей и запрос на обмен ключами с ней.
+func (c *Client) newKeyExchangeRequest() (*protocol.KeyExchangeRequest, error) {
+	var err error
+	c.PrivateKey, c.PublicKey, err = cryptography.GenerateKeyPair()
 	if err != nil {
-		return fmt.Errorf("failed to send public key: %w", err)
+		return nil, fmt.Errorf("failed to generate client keys: %w", err)
 	}
-	defer resp.Body.Close()
 
-	var result struct {
-		ServerPublicKey string `json:"ServerPublicKey"`
-		SessionID       string `json:"SessionID"`
-		Error           string `json:"Error"`
+	suites := make([]string, len(c.CipherSuites))
+	for i, suite := range c.CipherSuites {
+		suites[i] = string(suite)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return fmt.Errorf("failed to parse server response: %w", err)
+
+	return &protocol.KeyExchangeRequest{
+		Envelope:        protocol.NewEnvelope(),
+		ClientPublicKey: c.PublicKey[:],
+		CipherSuites:    suites,
+		RoomID:          c.RoomID,
+		InitData:        c.InitData,
+	}, nil
+}
+
+// call отправляет конверт request на адрес path сервера в формате c.Codec
+// и записывает конверт ответа в response. Если authenticated, запрос подписывается
+// идентификатором сессии и EAPI. Ошибка сервера возвращается как *protocol.Error.
+// Если сервер отвечает 429, запрос повторяется после паузы из заголовка Retry-After,
+// а без него — с экспоненциально растущей паузой. Когда попытки исчерпаны,
+// возвращается ErrRateLimited. Запрос и ожидание перед повтором прерываются
+// отменой контекста ctx.
+func (c *Client) call(ctx context.Context, path string, request, response any, authenticated bool) error {
+	body, err := c.Codec.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %w", err)
 	}
 
-	if result.Error != "" {
-		return fmt.Errorf("server returned an error: %s", result.Error)
+	delay := initialRetryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.ServerURL+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", c.Codec.ContentType())
+		req.Header.Set("Accept", c.Codec.ContentType())
+		if authenticated {
+			req.Header.Set("X-Session-ID", c.SessionID)
+			req.Header.Set("X-EAPI", c.GetCurrentEAPI())
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			defer resp.Body.Close()
+			return decodeResponse(resp, response)
+		}
+		resp.Body.Close()
+
+		if attempt == maxRateLimitRetries {
+			return ErrRateLimited
+		}
+
+		wait := delay
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			wait = time.Duration(seconds) * time.Second
+		}
+		wait = min(wait, maxRetryDelay)
+		log.Printf("rate limited by server, retrying %s in %s", path, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		delay = min(delay*2, maxRetryDelay)
 	}
+}
 
-	serverPublicKey, err := hex.DecodeString(result.ServerPublicKey)
-	if err != nil {
-		return fmt.Errorf("failed to decode server public key: %w", err)
+// decodeResponse разбирает конверт ответа resp в формате из заголовка Content-Type
+// и записывает его в v. Ответ с ошибкой возвращается как *protocol.Error.
+func decodeResponse(resp *http.Response, v any) error {
+	codec, ok := protocol.CodecFor(resp.Header.Get("Content-Type"))
+	if resp.StatusCode >= http.StatusBadRequest {
+		var result protocol.ErrorResponse
+		if data, err := io.ReadAll(resp.Body); ok && err == nil && codec.Unmarshal(data, &result) == nil && result.Error != nil {
+			return result.Error
+		}
+		return fmt.Errorf("server returned status %d", resp.StatusCode)
 	}
 
-	c.SharedKey, err = cryptography.ComputeSharedSecret(c.PrivateKey, *(*[32]byte)(serverPublicKey))
+	if v == nil {
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("unsupported response content type %q", resp.Header.Get("Content-Type"))
+	}
+	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to create SharedKey: %w", err)
+		return fmt.Errorf("failed to read server response: %w", err)
+	}
+	if err := codec.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse server response: %w", err)
+	}
+	return nil
+}
+
+// isUnauthorized сообщает, отклонил ли сервер сессию клиента.
+func isUnauthorized(err error) bool {
+	var protocolErr *protocol.Error
+	return errors.As(err, &protocolErr) && protocolErr.Code == protocol.CodeUnauthorized
+}
+
+// completeKeyExchange завершает рукопожатие по ответу сервера, проверяет подпись
+// стенограммы, вычисляет ключ доступа и сохраняет сессию в хранилище.
+// Эфемерный приватный ключ клиента после этого стирается.
+func (c *Client) completeKeyExchange(result *protocol.KeyExchangeResponse) error {
+	defer clear(c.PrivateKey[:])
+
+	if result.Version != protocol.Version {
+		return fmt.Errorf("unexpected key exchange version: %d", result.Version)
+	}
+	serverPublicKey, serverEphemeralKey := result.ServerPublicKey, result.ServerEphemeralKey
+	if len(serverPublicKey) != 32 {
+		return fmt.Errorf("invalid server public key length: %d", len(serverPublicKey))
+	}
+	if len(serverEphemeralKey) != 32 {
+		return fmt.Errorf("invalid server ephemeral key length: %d", len(serverEphemeralKey))
 	}
 
-	c.SessionID = result.SessionID
+	suite := cryptography.CipherSuite(result.CipherSuite)
+	if !slices.Contains(c.CipherSuites, suite) {
+		return fmt.Errorf("server chose cipher suite %q that was not offered", result.CipherSuite)
+	}
 
-	c.DerivedKey, err = cryptography.GenerateSessionKey(c.SharedKey[:], c.SessionID)
+	prologue := cryptography.NegotiationPrologue(c.CipherSuites)
+	handshake, err := cryptography.ClientHandshake(prologue, c.PrivateKey, [32]byte(serverEphemeralKey), [32]byte(serverPublicKey), result.SessionID)
 	if err != nil {
-		return fmt.Errorf("failed to derive DerivedKey: %w", err)
+		return fmt.Errorf("failed to complete handshake: %w", err)
 	}
 
+	switch {
+	case c.ServerIdentityKey != nil:
+		if !cryptography.VerifyTranscript(c.ServerIdentityKey, handshake.Hash, result.Signature) {
+			return ErrUntrustedServer
+		}
+	case c.InsecureSkipVerify:
+		log.Printf("server identity key is not pinned, key exchange is not authenticated")
+	default:
+		return fmt.Errorf("%w: server identity key is not pinned", ErrUntrustedServer)
+	}
+
+	if c.KeyID != "" && c.KeyID != result.KeyID {
+		log.Printf("server key rotated: %s -> %s", c.KeyID, result.KeyID)
+	}
+	c.KeyID = result.KeyID
+	c.CipherSuite = suite
+	c.SessionID = result.SessionID
+	c.Sequence = 0
+	c.DerivedKey = handshake.SessionKey
+
 	c.AccessKey, err = cryptography.GenerateAccessKey(c.DerivedKey)
 	if err != nil {
 		return fmt.Errorf("failed to derive AccessKey: %w", err)
 	}
 
-	c.saveSessionToLocalStorage()
+	c.saveSession()
 	return nil
 }
 
@@ -126,39 +345,87 @@ func (c *Client) GetCurrentEAPI() string {
 }
 
 // SendMessageToServer отправляет зашифрованное сообщение на сервер.
-func (c *Client) SendMessageToServer(message string) (string, error) {
-	encrypted, err := cryptography.EncryptAES([]byte(message), c.AccessKey)
+// Каждое сообщение получает новый порядковый номер, который сервер проверяет на повтор.
+func (c *Client) SendMessageToServer(ctx context.Context, message string) (string, error) {
+	c.Sequence++
+	c.saveSession()
+	header := cryptography.MessageHeader{SessionID: c.SessionID, Direction: cryptography.ClientToServer, Type: cryptography.MessageAction, Sequence: c.Sequence}
+
+	encrypted, err := cryptography.SealMessage([]byte(message), c.AccessKey, c.CipherSuite, header)
 	if err != nil {
 		return "", fmt.Errorf("failed to encrypt message: %w", err)
 	}
 
-	resp, err := http.PostForm(c.ServerURL+"/action", url.Values{
-		"Data":      {encrypted},
-		"EAPI":      {c.GetCurrentEAPI()},
-		"SessionID": {c.SessionID},
-	})
-	if err != nil {
+	request := protocol.ActionRequest{
+		Envelope: protocol.NewEnvelope(),
+		Seq:      c.Sequence,
+		Data:     encrypted,
+	}
+	var response protocol.ActionResponse
+	if err := c.call(ctx, "/action", request, &response, true); err != nil {
+		if isUnauthorized(err) {
+			c.ClearSession()
+			return "", ErrSessionExpired
+		}
 		return "", fmt.Errorf("failed to send encrypted message: %w", err)
 	}
-	defer resp.Body.Close()
 
-	var response struct {
-		Data  string `json:"Data"`
-		Error string `json:"Error"`
+	header.Direction = cryptography.ServerToClient
+	decrypted, err := cryptography.OpenMessage(response.Data, c.AccessKey, c.CipherSuite, header)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt server response: %w", err)
+	}
+
+	return string(decrypted), nil
+}
+
+// SendAction отправляет на сервер действие actionType с нагрузкой payload
+// и записывает нагрузку ответа в result. Ошибка сервера возвращается как *protocol.Error.
+func (c *Client) SendAction(ctx context.Context, actionType string, payload, result any) error {
+	message, err := protocol.EncodeAction(actionType, payload)
+	if err != nil {
+		return err
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return "", fmt.Errorf("failed to parse server response: %w", err)
+	response, err := c.SendMessageToServer(ctx, string(message))
+	if err != nil {
+		return err
 	}
 
-	if response.Error != "" {
-		return "", fmt.Errorf("server returned an error: %s", response.Error)
+	return protocol.DecodeResult([]byte(response), result)
+}
+
+// RefreshSession обновляет ключ доступа сессии без повторного обмена ключами.
+func (c *Client) RefreshSession(ctx context.Context) error {
+	var result struct {
+		Nonce string `json:"Nonce"`
+	}
+	if err := c.SendAction(ctx, "session.refresh", nil, &result); err != nil {
+		return fmt.Errorf("failed to refresh session: %w", err)
 	}
 
-	decrypted, err := cryptography.DecryptAES(response.Data, c.AccessKey)
+	nonce, err := hex.DecodeString(result.Nonce)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt server response: %w", err)
+		return fmt.Errorf("failed to decode refresh nonce: %w", err)
 	}
 
-	return decrypted, nil
+	c.AccessKey, err = cryptography.RefreshAccessKey(c.AccessKey, nonce)
+	if err != nil {
+		return fmt.Errorf("failed to derive AccessKey: %w", err)
+	}
+
+	c.saveSession()
+	return nil
+}
+
+// Logout завершает сессию на сервере и удаляет ее из хранилища.
+// Сессия, которую сервер уже не принимает, считается завершенной.
+func (c *Client) Logout(ctx context.Context) error {
+	err := c.call(ctx, "/logout", protocol.NewEnvelope(), nil, true)
+	c.ClearSession()
+
+	if err != nil && !isUnauthorized(err) {
+		return fmt.Errorf("failed to log out: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,352 @@
+package e2e
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"cu/common/cryptography"
+	"cu/common/protocol"
+
+	"github.com/looplab/fsm"
+)
+
+// Состояния сессии E2EE.
+const (
+	StateInitial       = "initial"
+	StateSessionLoaded = "session_loaded"
+	StateKeysExchanged = "keys_exchanged"
+	StateReady         = "ready"
+	StateError         = "error"
+	StateClosed        = "closed"
+)
+
+// События конечного автомата сессии.
+const (
+	eventLoad         = "load"
+	eventExchangeKeys = "exchange_keys"
+	eventReady        = "ready"
+	eventFail         = "fail"
+	eventClose        = "close"
+)
+
+// Параметры повторов при сетевых ошибках по умолчанию.
+const (
+	DefaultMaxRetries     = 5
+	DefaultInitialBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff     = 15 * time.Second
+)
+
+// ErrSessionClosed возвращается при обращении к закрытой сессии.
+var ErrSessionClosed = errors.New("session closed")
+
+// Config содержит параметры сессии E2EE.
+// Нулевые значения полей заменяются значениями по умолчанию.
+type Config struct {
+	// ServerURL — адрес сервера, например https://example.com. Обязателен.
+	ServerURL string
+	RoomID    string
+	InitData  string
+	// Store хранит сессию между запусками. По умолчанию в браузере используется
+	// localStorage, в остальных средах — память.
+	Store SessionStore
+	// Codec — формат конвертов. По умолчанию protocol.CBOR.
+	Codec protocol.Codec
+	// ServerIdentityKey — ключ подписи сервера для проверки обмена ключами.
+	// По умолчанию используется ключ, встроенный при сборке.
+	ServerIdentityKey ed25519.PublicKey
+	// InsecureSkipVerify разрешает обмен ключами без ключа подписи сервера,
+	// см. Client.InsecureSkipVerify.
+	InsecureSkipVerify bool
+	// CipherSuites — наборы шифров, которые клиент предлагает серверу, в порядке
+	// предпочтения. По умолчанию в браузере первым предлагается XChaCha20-Poly1305,
+	// в остальных средах — AES-256-GCM.
+	CipherSuites []cryptography.CipherSuite
+	// MaxRetries — число повторов запроса при сетевой ошибке.
+	// Отрицательное значение отключает повторы.
+	MaxRetries int
+	// InitialBackoff — пауза перед первым повтором. Каждая следующая пауза
+	// вдвое длиннее предыдущей, но не длиннее MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// Event описывает изменение состояния сессии.
+type Event struct {
+	From string
+	To   string
+	// Err — ошибка, из-за которой сессия перешла в StateError.
+	Err error
+}
+
+// listener — подписчик на изменения состояния сессии.
+type listener struct {
+	id int
+	fn func(Event)
+}
+
+// Session управляет зашифрованной сессией с сервером на протяжении всей жизни игры.
+// Сессия загружает сохраненные ключи, а если сервер их больше не принимает,
+// выполняет обмен ключами заново. Запросы, не дошедшие до сервера, повторяются
+// с экспоненциальной паузой. Методы Session можно вызывать из нескольких горутин.
+type Session struct {
+	client  *Client
+	config  Config
+	machine *fsm.FSM
+
+	// mu упорядочивает запросы к серверу: порядковые номера сообщений должны расти.
+	mu sync.Mutex
+
+	listenersMu  sync.Mutex
+	listeners    []listener
+	nextListener int
+}
+
+// NewSession создает сессию с параметрами config. Соединение с сервером
+// не устанавливается до вызова Start или Send.
+func NewSession(config Config) (*Session, error) {
+	if config.ServerURL == "" {
+		return nil, errors.New("server URL is required")
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultMaxRetries
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = DefaultInitialBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultMaxBackoff
+	}
+
+	client, err := NewClient(config.ServerURL)
+	if err != nil {
+		return nil, err
+	}
+	client.RoomID = config.RoomID
+	client.InitData = config.InitData
+	if config.Store != nil {
+		client.Store = config.Store
+	}
+	if config.Codec != nil {
+		client.Codec = config.Codec
+	}
+	if config.ServerIdentityKey != nil {
+		client.ServerIdentityKey = config.ServerIdentityKey
+	}
+	if config.InsecureSkipVerify {
+		client.InsecureSkipVerify = true
+	}
+	if len(config.CipherSuites) > 0 {
+		client.CipherSuites = config.CipherSuites
+	}
+
+	s := &Session{client: client, config: config}
+	s.machine = fsm.NewFSM(
+		StateInitial,
+		fsm.Events{
+			{Name: eventLoad, Src: []string{StateInitial, StateError}, Dst: StateSessionLoaded},
+			{Name: eventExchangeKeys, Src: []string{StateInitial, StateSessionLoaded, StateReady, StateError}, Dst: StateKeysExchanged},
+			{Name: eventReady, Src: []string{StateSessionLoaded, StateKeysExchanged}, Dst: StateReady},
+			{Name: eventFail, Src: []string{StateInitial, StateSessionLoaded, StateKeysExchanged, StateReady}, Dst: StateError},
+			{Name: eventClose, Src: []string{StateInitial, StateSessionLoaded, StateKeysExchanged, StateReady, StateError}, Dst: StateClosed},
+		},
+		fsm.Callbacks{
+			"enter_state": func(_ context.Context, e *fsm.Event) {
+				s.publish(e)
+			},
+		},
+	)
+	return s, nil
+}
+
+// Client возвращает клиент сессии, например для открытия WebSocket-туннеля.
+func (s *Session) Client() *Client {
+	return s.client
+}
+
+// State возвращает текущее состояние сессии.
+func (s *Session) State() string {
+	return s.machine.Current()
+}
+
+// Subscribe подписывает fn на изменения состояния сессии и возвращает функцию отписки.
+// Подписчики вызываются синхронно в горутине, изменившей состояние, поэтому
+// не должны блокироваться и вызывать методы Start, Send и Close.
+func (s *Session) Subscribe(fn func(Event)) (unsubscribe func()) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+
+	id := s.nextListener
+	s.nextListener++
+	s.listeners = append(s.listeners, listener{id: id, fn: fn})
+
+	return func() {
+		s.listenersMu.Lock()
+		defer s.listenersMu.Unlock()
+		for i, l := range s.listeners {
+			if l.id == id {
+				s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Start подготавливает сессию к отправке сообщений. Сохраненная сессия
+// проверяется запросом ping; если сервер ее не принимает или ее нет,
+// выполняется обмен ключами. При неудаче сессия переходит в StateError,
+// и Start можно вызвать повторно.
+func (s *Session) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.start(ctx)
+}
+
+// Send отправляет на сервер действие actionType с нагрузкой payload и записывает
+// нагрузку ответа в result. Ошибка сервера возвращается как *protocol.Error.
+// Если сессия еще не готова, Send сначала выполняет Start. Если сервер забыл
+// сессию, Send получает новую и повторяет действие один раз.
+// Повтор после сетевой ошибки может выполнить действие на сервере дважды,
+// если до сбоя запрос успел дойти.
+func (s *Session) Send(ctx context.Context, actionType string, payload, result any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.start(ctx); err != nil {
+		return err
+	}
+
+	send := func() error {
+		return s.client.SendAction(ctx, actionType, payload, result)
+	}
+	err := s.retry(ctx, send)
+	if errors.Is(err, ErrSessionExpired) {
+		if err := s.exchangeKeys(ctx); err != nil {
+			return err
+		}
+		err = s.retry(ctx, send)
+	}
+	if isNetworkError(err) || errors.Is(err, ErrSessionExpired) {
+		s.transition(eventFail, err)
+	}
+	return err
+}
+
+// Close завершает сессию на сервере. После Close сессию нельзя использовать.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.machine.Is(StateClosed) {
+		return nil
+	}
+
+	var err error
+	if s.client.SessionID != "" {
+		err = s.client.Logout(context.Background())
+	}
+	s.transition(eventClose)
+	return err
+}
+
+// start выполняет Start. Вызывается под s.mu.
+func (s *Session) start(ctx context.Context) error {
+	switch s.machine.Current() {
+	case StateReady:
+		return nil
+	case StateClosed:
+		return ErrSessionClosed
+	}
+
+	if s.client.SessionID != "" || s.client.LoadSession() {
+		s.transition(eventLoad)
+		err := s.retry(ctx, func() error {
+			return s.client.SendAction(ctx, "ping", nil, nil)
+		})
+		if err == nil {
+			s.transition(eventReady)
+			return nil
+		}
+		if !errors.Is(err, ErrSessionExpired) {
+			s.transition(eventFail, err)
+			return fmt.Errorf("failed to check saved session: %w", err)
+		}
+	}
+
+	return s.exchangeKeys(ctx)
+}
+
+// exchangeKeys получает новую сессию и переводит ее в StateReady.
+// При неудаче сессия переходит в StateError.
+func (s *Session) exchangeKeys(ctx context.Context) error {
+	err := s.retry(ctx, func() error {
+		return s.client.ExchangeKeysWithServer(ctx)
+	})
+	if err != nil {
+		s.transition(eventFail, err)
+		return err
+	}
+	s.transition(eventExchangeKeys)
+	s.transition(eventReady)
+	return nil
+}
+
+// retry выполняет op и повторяет его после сетевых ошибок, пока не исчерпаны
+// попытки или не отменен контекст ctx.
+func (s *Session) retry(ctx context.Context, op func() error) error {
+	backoff := s.config.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || !isNetworkError(err) || attempt >= s.config.MaxRetries {
+			return err
+		}
+
+		log.Printf("request failed, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, s.config.MaxBackoff)
+	}
+}
+
+// transition переводит автомат сессии по событию event.
+// Аргументы args передаются подписчикам; первым может быть ошибка.
+func (s *Session) transition(event string, args ...any) {
+	// Контекст автомата не связан с запросом: отмена запроса не должна
+	// оставлять сессию в прежнем состоянии.
+	err := s.machine.Event(context.Background(), event, args...)
+	var noTransition fsm.NoTransitionError
+	if err != nil && !errors.As(err, &noTransition) {
+		log.Printf("invalid session transition %q: %v", event, err)
+	}
+}
+
+// publish сообщает подписчикам о переходе e.
+func (s *Session) publish(e *fsm.Event) {
+	event := Event{From: e.Src, To: e.Dst}
+	if len(e.Args) > 0 {
+		event.Err, _ = e.Args[0].(error)
+	}
+
+	s.listenersMu.Lock()
+	listeners := make([]listener, len(s.listeners))
+	copy(listeners, s.listeners)
+	s.listenersMu.Unlock()
+
+	for _, l := range listeners {
+		l.fn(event)
+	}
+}
+
+// isNetworkError сообщает, что запрос не дошел до сервера или ответ не был получен.
+func isNetworkError(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
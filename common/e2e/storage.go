@@ -0,0 +1,141 @@
+package e2e
+
+import (
+	"cu/common/cryptography"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrNoSession возвращается хранилищем, если сохраненной сессии нет.
+var ErrNoSession = errors.New("no saved session")
+
+// SavedSession содержит данные сессии, которые переживают перезапуск клиента.
+type SavedSession struct {
+	// Version — версия протокола, по которой получена сессия.
+	Version     int                      `json:"Version"`
+	CipherSuite cryptography.CipherSuite `json:"CipherSuite"`
+	SessionID   string                   `json:"SessionID"`
+	KeyID       string                   `json:"KeyID"`
+	AccessKey   []byte                   `json:"AccessKey"`
+	// Sequence — номер последнего отправленного сообщения. Без него после перезапуска
+	// сервер отверг бы новые сообщения как повторные.
+	Sequence uint64 `json:"Sequence"`
+}
+
+// SessionStore сохраняет сессию клиента между запусками.
+type SessionStore interface {
+	// Load возвращает сохраненную сессию или ErrNoSession, если ее нет.
+	Load() (*SavedSession, error)
+	// Save сохраняет сессию, заменяя предыдущую.
+	Save(session *SavedSession) error
+	// Clear удаляет сохраненную сессию.
+	Clear() error
+}
+
+// MemoryStore хранит сессию в памяти процесса.
+// Подходит для тестов и ботов, которым не нужно восстанавливать сессию после перезапуска.
+type MemoryStore struct {
+	mu      sync.Mutex
+	session *SavedSession
+}
+
+// NewMemoryStore создает пустое хранилище сессии в памяти.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Load возвращает копию сохраненной сессии.
+func (s *MemoryStore) Load() (*SavedSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session == nil {
+		return nil, ErrNoSession
+	}
+	session := *s.session
+	return &session, nil
+}
+
+// Save сохраняет копию сессии.
+func (s *MemoryStore) Save(session *SavedSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *session
+	s.session = &saved
+	return nil
+}
+
+// Clear удаляет сохраненную сессию.
+func (s *MemoryStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session = nil
+	return nil
+}
+
+// FileStore хранит сессию в JSON-файле.
+// Файл доступен только владельцу, так как содержит ключ доступа.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore создает хранилище сессии в файле path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Load читает сессию из файла.
+func (s *FileStore) Load() (*SavedSession, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNoSession
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session file: %w", err)
+	}
+
+	var session SavedSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to decode session file: %w", err)
+	}
+	return &session, nil
+}
+
+// Save записывает сессию во временный файл и переименовывает его,
+// чтобы прерванная запись не повредила сохраненную сессию.
+func (s *FileStore) Save(session *SavedSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create session file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	if err := os.Rename(file.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace session file: %w", err)
+	}
+	return nil
+}
+
+// Clear удаляет файл сессии.
+func (s *FileStore) Clear() error {
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove session file: %w", err)
+	}
+	return nil
+}
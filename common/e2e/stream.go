@@ -0,0 +1,159 @@
+package e2e
+
+import (
+	"context"
+	"cu/common/cryptography"
+	"cu/common/protocol"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// Stream представляет зашифрованный туннель к серверу поверх WebSocket.
+// В отличие от SendMessageToServer, сервер может сам отправлять сообщения в поток.
+// Сообщения каждого направления нумеруются, номер привязывается к шифротексту.
+type Stream struct {
+	conn      *websocket.Conn
+	sessionID string
+	accessKey []byte
+	suite     cryptography.CipherSuite
+
+	sendMu       sync.Mutex
+	sendSequence uint64
+	recvSequence uint64
+}
+
+// OpenStream открывает WebSocket-туннель и выполняет в нем обмен ключами.
+// После успешного открытия клиент получает новую сессию.
+// Если сервер отклонил туннель из-за ограничения частоты или числа сессий,
+// возвращается ErrRateLimited, и открытие следует повторить позже.
+func (c *Client) OpenStream(ctx context.Context) (*Stream, error) {
+	conn, resp, err := websocket.Dial(ctx, tunnelURL(c.ServerURL), nil)
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return nil, ErrRateLimited
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tunnel: %w", err)
+	}
+
+	request, err := c.newKeyExchangeRequest()
+	if err != nil {
+		conn.CloseNow()
+		return nil, err
+	}
+	if err := wsjson.Write(ctx, conn, request); err != nil {
+		conn.CloseNow()
+		return nil, fmt.Errorf("failed to send public key: %w", err)
+	}
+
+	// Сервер отвечает либо KeyExchangeResponse, либо ErrorResponse.
+	var result struct {
+		protocol.KeyExchangeResponse
+		Error *protocol.Error `json:"Error"`
+	}
+	if err := wsjson.Read(ctx, conn, &result); err != nil {
+		conn.CloseNow()
+		if websocket.CloseStatus(err) == websocket.StatusTryAgainLater {
+			return nil, ErrRateLimited
+		}
+		return nil, fmt.Errorf("failed to parse server response: %w", err)
+	}
+	if result.Error != nil {
+		conn.CloseNow()
+		if result.Error.Code == protocol.CodeRateLimited {
+			return nil, ErrRateLimited
+		}
+		return nil, fmt.Errorf("failed to exchange keys: %w", result.Error)
+	}
+
+	if err := c.completeKeyExchange(&result.KeyExchangeResponse); err != nil {
+		conn.CloseNow()
+		return nil, err
+	}
+
+	return &Stream{conn: conn, sessionID: c.SessionID, accessKey: c.AccessKey, suite: c.CipherSuite}, nil
+}
+
+// Send шифрует сообщение и отправляет его в туннель.
+func (s *Stream) Send(ctx context.Context, message string) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.sendSequence++
+	encrypted, err := cryptography.SealMessage([]byte(message), s.accessKey, s.suite, s.header(cryptography.ClientToServer, s.sendSequence))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt message: %w", err)
+	}
+
+	if err := s.conn.Write(ctx, websocket.MessageBinary, encrypted); err != nil {
+		return fmt.Errorf("failed to send encrypted message: %w", err)
+	}
+	return nil
+}
+
+// Receive ожидает следующее сообщение от сервера и расшифровывает его.
+// Это может быть как ответ на Send, так и сообщение, отправленное сервером по своей инициативе.
+// Receive нельзя вызывать одновременно из нескольких горутин.
+// Если сервер закрыл туннель из-за того, что сессия больше не действует, возвращается ErrSessionExpired.
+func (s *Stream) Receive(ctx context.Context) (string, error) {
+	_, data, err := s.conn.Read(ctx)
+	if websocket.CloseStatus(err) == websocket.StatusCode(protocol.TunnelStatusSessionClosed) {
+		return "", fmt.Errorf("%w: %w", ErrSessionExpired, err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read from tunnel: %w", err)
+	}
+
+	s.recvSequence++
+	decrypted, err := cryptography.OpenMessage(data, s.accessKey, s.suite, s.header(cryptography.ServerToClient, s.recvSequence))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt server message: %w", err)
+	}
+
+	return string(decrypted), nil
+}
+
+// header возвращает заголовок сообщения туннеля с направлением direction и номером sequence.
+func (s *Stream) header(direction cryptography.Direction, sequence uint64) cryptography.MessageHeader {
+	return cryptography.MessageHeader{SessionID: s.sessionID, Direction: direction, Type: cryptography.MessageTunnel, Sequence: sequence}
+}
+
+// SendAction отправляет в туннель действие actionType с нагрузкой payload.
+// Ответ сервера можно получить через ReceiveResult.
+func (s *Stream) SendAction(ctx context.Context, actionType string, payload any) error {
+	message, err := protocol.EncodeAction(actionType, payload)
+	if err != nil {
+		return err
+	}
+	return s.Send(ctx, string(message))
+}
+
+// ReceiveResult ожидает следующий ответ сервера и записывает его нагрузку в result.
+// Ошибка сервера возвращается как *protocol.Error.
+func (s *Stream) ReceiveResult(ctx context.Context, result any) error {
+	message, err := s.Receive(ctx)
+	if err != nil {
+		return err
+	}
+	return protocol.DecodeResult([]byte(message), result)
+}
+
+// Close закрывает туннель.
+func (s *Stream) Close() error {
+	return s.conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// tunnelURL преобразует HTTP-адрес сервера в адрес WebSocket-туннеля.
+func tunnelURL(serverURL string) string {
+	switch {
+	case strings.HasPrefix(serverURL, "https://"):
+		serverURL = "wss://" + strings.TrimPrefix(serverURL, "https://")
+	case strings.HasPrefix(serverURL, "http://"):
+		serverURL = "ws://" + strings.TrimPrefix(serverURL, "http://")
+	}
+	return strings.TrimSuffix(serverURL, "/") + "/tunnel"
+}
@@ -3,6 +3,8 @@ module cu/common
 go 1.23.1
 
 require (
+	github.com/coder/websocket v1.8.12
+	github.com/fxamacker/cbor/v2 v2.7.0
 	github.com/looplab/fsm v1.0.2
 	github.com/tinne26/etxt v0.0.8
 	golang.org/x/crypto v0.32.0
@@ -13,6 +15,7 @@ require (
 	github.com/go-gl/glfw/v3.3/glfw v0.0.0-20221017161538-93cebf72946b // indirect
 	github.com/hajimehoshi/ebiten/v2 v2.5.0 // indirect
 	github.com/jezek/xgb v1.1.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/exp v0.0.0-20190731235908-ec7cb31e5a56 // indirect
 	golang.org/x/image v0.9.0 // indirect
 	golang.org/x/mobile v0.0.0-20230301163155-e0f57694e12c // indirect
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Коды ошибок, которые сервер возвращает в конвертах Result и ErrorResponse.
+const (
+	CodeInternal             = "internal"
+	CodeUnauthorized         = "unauthorized"
+	CodeUnsupportedVersion   = "unsupported_version"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeReplayedSequence     = "replayed_sequence"
+	CodeInvalidInitData      = "invalid_init_data"
+
+	CodeBadRequest    = "bad_request"
+	CodeUnknownAction = "unknown_action"
+	CodeHandlerFailed = "handler_failed"
+	CodeRoomNotFound  = "room_not_found"
+	CodeRoomExists    = "room_exists"
+	CodeRoomFull      = "room_full"
+	CodeNotInRoom     = "not_in_room"
+	CodeRateLimited   = "rate_limited"
+)
+
+// TunnelStatusSessionClosed — код закрытия WebSocket-туннеля, если его сессия истекла,
+// завершена выходом или отозвана либо ее ключ доступа обновлен вне туннеля.
+// Код из диапазона 4000–4999, отведенного приложениям.
+const TunnelStatusSessionClosed = 4001
+
+// Action представляет именованное действие клиента с произвольной нагрузкой.
+type Action struct {
+	Type    string          `json:"Type"`
+	Payload json.RawMessage `json:"Payload,omitempty"`
+}
+
+// Result представляет ответ сервера на действие: нагрузку или ошибку.
+type Result struct {
+	Payload json.RawMessage `json:"Payload,omitempty"`
+	Error   *Error          `json:"Error,omitempty"`
+}
+
+// Error описывает ошибку обработки действия на сервере.
+type Error struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+}
+
+// Error реализует интерфейс error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// NewError создает ошибку с кодом code и текстом message.
+func NewError(code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// EncodeAction сериализует действие actionType с нагрузкой payload.
+func EncodeAction(actionType string, payload any) ([]byte, error) {
+	action := Action{Type: actionType}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode payload: %w", err)
+		}
+		action.Payload = data
+	}
+	return json.Marshal(action)
+}
+
+// DecodeResult разбирает ответ сервера и записывает нагрузку в v.
+// Если сервер вернул ошибку, она возвращается как *Error.
+func DecodeResult(data []byte, v any) error {
+	var result Result
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("failed to decode result: %w", err)
+	}
+	if result.Error != nil {
+		return result.Error
+	}
+	if v == nil || len(result.Payload) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(result.Payload, v); err != nil {
+		return fmt.Errorf("failed to decode result payload: %w", err)
+	}
+	return nil
+}
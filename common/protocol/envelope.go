@@ -0,0 +1,191 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Версии протокола. Версия конверта запроса обмена ключами выбирает рукопожатие,
+// остальные конверты разных версий не отличаются.
+const (
+	// VersionStaticKey — обмен ключами со статическим ключом сервера X25519.
+	// Поддерживается для старых клиентов.
+	VersionStaticKey = 1
+	// VersionEphemeral — рукопожатие с эфемерными ключами обеих сторон,
+	// см. cryptography.ClientHandshake.
+	VersionEphemeral = 2
+	// VersionBoundMessages — рукопожатие VersionEphemeral, а сообщения сессии шифруются
+	// ключами направлений с заголовком, см. cryptography.SealMessage. Сессии прежних
+	// версий шифруют сообщения ключом доступа с порядковым номером в дополнительных данных.
+	VersionBoundMessages = 3
+	// VersionCipherSuites — клиент предлагает наборы шифров, сервер выбирает один из них,
+	// а предложение входит в подписанную стенограмму рукопожатия как пролог.
+	// Сессии прежних версий шифруют сообщения AES-256-GCM.
+	VersionCipherSuites = 4
+
+	// Version — версия, которую отправляет клиент.
+	Version = VersionCipherSuites
+	// MinVersion — самая старая версия, которую принимает сервер.
+	MinVersion = VersionStaticKey
+)
+
+// Типы содержимого, в которых передаются конверты протокола.
+const (
+	ContentTypeJSON = "application/json"
+	ContentTypeCBOR = "application/cbor"
+)
+
+// Envelope — общий заголовок всех конвертов протокола.
+type Envelope struct {
+	Version int `json:"Version"`
+}
+
+// NewEnvelope возвращает заголовок конверта текущей версии.
+func NewEnvelope() Envelope {
+	return Envelope{Version: Version}
+}
+
+// CheckVersion возвращает ошибку CodeUnsupportedVersion, если версия конверта не поддерживается.
+func (e Envelope) CheckVersion() error {
+	if e.Version < MinVersion || e.Version > Version {
+		return NewError(CodeUnsupportedVersion, fmt.Sprintf("Unsupported protocol version %d", e.Version))
+	}
+	return nil
+}
+
+// KeyExchangeRequest — запрос клиента на обмен ключами.
+// Начиная с версии VersionEphemeral ClientPublicKey — эфемерный ключ клиента, новый для каждого обмена.
+// CipherSuites — наборы шифров, которые поддерживает клиент, в порядке предпочтения.
+type KeyExchangeRequest struct {
+	Envelope
+	ClientPublicKey []byte   `json:"ClientPublicKey"`
+	CipherSuites    []string `json:"CipherSuites,omitempty"`
+	RoomID          string   `json:"RoomID,omitempty"`
+	InitData        string   `json:"InitData,omitempty"`
+}
+
+// KeyExchangeResponse — ответ сервера на обмен ключами той же версии, что и запрос.
+// ServerPublicKey — статический ключ сервера X25519, ServerEphemeralKey — эфемерный ключ
+// сервера, который передается начиная с версии VersionEphemeral.
+// Signature — подпись Ed25519 долговременным ключом сервера: в версии VersionStaticKey
+// подписывается cryptography.HandshakeTranscript, в последующих —
+// хеш стенограммы рукопожатия cryptography.HandshakeResult.Hash.
+// CipherSuite — выбранный сервером набор шифров начиная с версии VersionCipherSuites.
+type KeyExchangeResponse struct {
+	Envelope
+	ServerPublicKey    []byte `json:"ServerPublicKey"`
+	ServerEphemeralKey []byte `json:"ServerEphemeralKey,omitempty"`
+	CipherSuite        string `json:"CipherSuite,omitempty"`
+	KeyID              string `json:"KeyID"`
+	SessionID          string `json:"SessionID"`
+	Signature          []byte `json:"Signature"`
+}
+
+// ActionRequest — зашифрованное действие клиента.
+// Seq — порядковый номер сообщения, привязанный к шифротексту Data.
+type ActionRequest struct {
+	Envelope
+	Seq  uint64 `json:"Seq"`
+	Data []byte `json:"Data"`
+}
+
+// ActionResponse — зашифрованный ответ сервера на действие.
+type ActionResponse struct {
+	Envelope
+	Data []byte `json:"Data"`
+}
+
+// ErrorResponse — ответ сервера с ошибкой. Им отвечают все конечные точки протокола.
+type ErrorResponse struct {
+	Envelope
+	Error *Error `json:"Error"`
+}
+
+// NewErrorResponse создает ответ с ошибкой err.
+func NewErrorResponse(err *Error) ErrorResponse {
+	return ErrorResponse{Envelope: NewEnvelope(), Error: err}
+}
+
+// Codec сериализует конверты протокола в одном из форматов.
+type Codec interface {
+	// ContentType возвращает тип содержимого формата.
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// JSON — текстовый формат конвертов. Двоичные поля кодируются в base64.
+	JSON Codec = jsonCodec{}
+	// CBOR — компактный двоичный формат конвертов (RFC 8949).
+	CBOR Codec = cborCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                { return ContentTypeJSON }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string                { return ContentTypeCBOR }
+func (cborCodec) Marshal(v any) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v any) error { return cbor.Unmarshal(data, v) }
+
+// CodecFor возвращает формат для типа содержимого contentType.
+// Параметры типа, например charset, не учитываются.
+func CodecFor(contentType string) (Codec, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	switch mediaType {
+	case ContentTypeJSON:
+		return JSON, true
+	case ContentTypeCBOR:
+		return CBOR, true
+	}
+	return nil, false
+}
+
+// Negotiate выбирает формат ответа по заголовку Accept с учетом весов q.
+// При равных весах предпочтение отдается типу, указанному раньше.
+// Если ни один поддерживаемый тип не принимается, используется JSON.
+func Negotiate(accept string) Codec {
+	var best Codec
+	bestQuality := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality <= bestQuality {
+			continue
+		}
+
+		codec, ok := CodecFor(mediaType)
+		if !ok && (mediaType == "*/*" || mediaType == "application/*") {
+			codec, ok = JSON, true
+		}
+		if ok {
+			best, bestQuality = codec, quality
+		}
+	}
+	if best == nil {
+		return JSON
+	}
+	return best
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"image/color"
+	"log"
 	"sync"
 	"time"
 
@@ -16,11 +18,17 @@ import (
 	"cu/game/widgets"
 )
 
+// serverURL — адрес игрового сервера. Задается при сборке флагом
+// -ldflags "-X main.serverURL=https://example.com". Если он пуст, используется адрес страницы.
+var serverURL string
+
 // Game представляет собой основную структуру игры.
 type Game struct {
 	screen   screen
 	gameUI   *ui.View
 	initOnce sync.Once
+	// session — зашифрованная сессия с сервером, через которую игра отправляет действия.
+	session *e2e.Session
 }
 
 // screen содержит размеры экрана.
@@ -176,11 +184,27 @@ func main() {
 	windowHeight := int(float64(defaultWindowHeight) * deviceScaleFactor)
 	ebiten.SetWindowSize(windowWidth, windowHeight)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel() // Освобождаем ресурсы контекста
-
-	// Инициализируем FSM и запускаем его
-	e2e.E2EE(ctx)
+	// Создаем сессию E2EE и подключаемся к серверу, не задерживая запуск игры.
+	game.session, err = e2e.NewSession(e2e.Config{
+		ServerURL: cmp.Or(serverURL, e2e.ServerURLFromWindow()),
+		RoomID:    e2e.RoomIDFromWindow(),
+		InitData:  e2e.TelegramInitDataFromWindow(),
+	})
+	if err != nil {
+		panic(err)
+	}
+	game.session.Subscribe(func(event e2e.Event) {
+		if event.Err != nil {
+			log.Printf("E2EE: %s -> %s: %v", event.From, event.To, event.Err)
+			return
+		}
+		log.Printf("E2EE: %s -> %s", event.From, event.To)
+	})
+	go func() {
+		if err := game.session.Start(context.Background()); err != nil {
+			log.Printf("E2EE session is not ready: %v", err)
+		}
+	}()
 
 	// Запускаем игровой цикл.
 	if err := ebiten.RunGame(game); err != nil && !errors.Is(err, ebiten.Termination) {
@@ -0,0 +1,111 @@
+package actions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"cu/common/protocol"
+	"cu/server/api/logging"
+	"cu/server/api/security"
+)
+
+// Request содержит данные действия, переданные обработчику.
+type Request struct {
+	SessionID string
+	Session   *security.ServerSession
+	Payload   json.RawMessage
+}
+
+// Decode разбирает нагрузку действия в v.
+func (r *Request) Decode(v any) error {
+	if len(r.Payload) == 0 {
+		return protocol.NewError(protocol.CodeBadRequest, "payload is required")
+	}
+	if err := json.Unmarshal(r.Payload, v); err != nil {
+		return protocol.NewError(protocol.CodeBadRequest, err.Error())
+	}
+	return nil
+}
+
+// Handler обрабатывает действие и возвращает нагрузку ответа.
+// Ошибка типа *protocol.Error передается клиенту как есть, остальные ошибки
+// записываются в журнал, а клиент получает protocol.CodeHandlerFailed без подробностей.
+type Handler func(ctx context.Context, req *Request) (any, error)
+
+// Registry хранит обработчики, зарегистрированные под именами действий.
+type Registry struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewRegistry создает пустой реестр действий.
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]Handler)}
+}
+
+// Handle регистрирует обработчик для действия actionType.
+func (r *Registry) Handle(actionType string, handler Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[actionType] = handler
+}
+
+// Dispatch разбирает расшифрованное сообщение, вызывает обработчик
+// и возвращает сериализованный конверт ответа.
+func (r *Registry) Dispatch(ctx context.Context, sessionID string, session *security.ServerSession, message []byte) []byte {
+	var action protocol.Action
+	if err := json.Unmarshal(message, &action); err != nil {
+		return encodeResult(nil, protocol.NewError(protocol.CodeBadRequest, "Unable to decode action"))
+	}
+
+	r.mu.RLock()
+	handler, ok := r.handlers[action.Type]
+	r.mu.RUnlock()
+	if !ok {
+		return encodeResult(nil, protocol.NewError(protocol.CodeUnknownAction, "Unknown action "+action.Type))
+	}
+
+	payload, err := handler(ctx, &Request{
+		SessionID: sessionID,
+		Session:   session,
+		Payload:   action.Payload,
+	})
+	if err != nil {
+		var protocolErr *protocol.Error
+		if !errors.As(err, &protocolErr) {
+			logging.FromContext(ctx).Error("Action handler failed", slog.String("action", action.Type), logging.Error(err))
+			protocolErr = protocol.NewError(protocol.CodeHandlerFailed, "Action failed")
+		}
+		return encodeResult(nil, protocolErr)
+	}
+
+	return encodeResult(payload, nil)
+}
+
+// EncodeError возвращает сериализованный конверт ответа с ошибкой resultErr.
+func EncodeError(resultErr *protocol.Error) []byte {
+	return encodeResult(nil, resultErr)
+}
+
+// encodeResult сериализует конверт ответа с нагрузкой payload или ошибкой.
+func encodeResult(payload any, resultErr *protocol.Error) []byte {
+	result := protocol.Result{Error: resultErr}
+	if resultErr == nil && payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			slog.Error("Failed to encode action result", logging.Error(err))
+			result.Error = protocol.NewError(protocol.CodeHandlerFailed, "Unable to encode result")
+		} else {
+			result.Payload = data
+		}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		slog.Error("Failed to encode action result envelope", logging.Error(err))
+	}
+	return data
+}
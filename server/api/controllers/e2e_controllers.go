@@ -1 +1,375 @@
 package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"cu/common/cryptography"
+	"cu/common/protocol"
+	"cu/server/api/actions"
+	"cu/server/api/logging"
+	"cu/server/api/metrics"
+	"cu/server/api/ratelimit"
+	"cu/server/api/security"
+	"cu/server/api/wire"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// ErrTunnelNotFound возвращается, если для сессии нет открытого туннеля.
+var ErrTunnelNotFound = errors.New("tunnel not found")
+
+// errAccessKeyChanged возвращается, если ключ доступа сессии обновлен вне туннеля.
+var errAccessKeyChanged = errors.New("session access key changed outside the tunnel")
+
+// tunnelCheckInterval — период проверки сессии открытого туннеля. Сессию, отозванную
+// другим процессом или истекшую, пока клиент молчит, туннель замечает не позже этого срока.
+const tunnelCheckInterval = time.Minute
+
+// tunnel представляет открытое WebSocket-соединение зашифрованного туннеля.
+// Каждое направление нумерует свои сообщения, номер привязывается к шифротексту,
+// поэтому повтор, удаление или перестановка кадров обнаруживаются.
+type tunnel struct {
+	conn      *websocket.Conn
+	sessionID string
+	session   *security.ServerSession
+	// cancel отменяет контекст обработчика туннеля, прерывая текущее действие.
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	sequence uint64
+}
+
+// send шифрует сообщение ключом доступа сессии и отправляет его клиенту.
+func (t *tunnel) send(ctx context.Context, message string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sequence++
+	encrypted, err := t.session.Seal([]byte(message), t.header(cryptography.ServerToClient, t.sequence))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt message: %w", err)
+	}
+	return t.conn.Write(ctx, websocket.MessageBinary, encrypted)
+}
+
+// validate проверяет, что сессия туннеля по-прежнему действует, и возвращает ее текущую запись.
+// Сессия недействительна, если она истекла, удалена при выходе или отзыве
+// либо ее ключ доступа обновлен: туннель шифруется ключом, полученным при открытии.
+// Если touch равен true, срок жизни сессии продлевается.
+func (t *tunnel) validate(sessions *security.SessionStorage, touch bool) (*security.ServerSession, error) {
+	var (
+		current *security.ServerSession
+		err     error
+	)
+	if touch {
+		current, err = sessions.TouchSession(t.sessionID)
+	} else {
+		current, err = sessions.GetSession(t.sessionID)
+		if err == nil && time.Now().After(current.ExpiresAt) {
+			err = security.ErrSessionExpired
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(current.AccessKey, t.session.AccessKey) {
+		return nil, errAccessKeyChanged
+	}
+	return current, nil
+}
+
+// closeSession закрывает туннель с кодом protocol.TunnelStatusSessionClosed.
+func (t *tunnel) closeSession(reason string) error {
+	return t.conn.Close(websocket.StatusCode(protocol.TunnelStatusSessionClosed), reason)
+}
+
+// header возвращает заголовок сообщения туннеля с направлением direction и номером sequence.
+func (t *tunnel) header(direction cryptography.Direction, sequence uint64) cryptography.MessageHeader {
+	return cryptography.MessageHeader{SessionID: t.sessionID, Direction: direction, Type: cryptography.MessageTunnel, Sequence: sequence}
+}
+
+// Hub хранит открытые туннели и позволяет серверу отправлять им сообщения.
+type Hub struct {
+	mu      sync.RWMutex
+	tunnels map[string]*tunnel
+	closed  bool
+
+	// handlers считает работающие обработчики туннелей, включая еще не
+	// зарегистрированные: они обращаются к хранилищу, пока не завершатся.
+	handlers sync.WaitGroup
+}
+
+// NewHub создает пустой реестр туннелей.
+func NewHub() *Hub {
+	return &Hub{tunnels: make(map[string]*tunnel)}
+}
+
+// begin отмечает начало работы обработчика туннеля.
+// После Shutdown новые обработчики не запускаются, и begin возвращает false.
+// Каждому успешному вызову begin должен соответствовать вызов end.
+func (h *Hub) begin() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return false
+	}
+	h.handlers.Add(1)
+	return true
+}
+
+// end отмечает завершение работы обработчика туннеля.
+func (h *Hub) end() {
+	h.handlers.Done()
+}
+
+// add регистрирует туннель для сессии sessionID.
+// После Shutdown новые туннели не принимаются, и add возвращает false.
+func (h *Hub) add(sessionID string, t *tunnel) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return false
+	}
+	h.tunnels[sessionID] = t
+	return true
+}
+
+// remove удаляет туннель сессии sessionID, если он все еще зарегистрирован.
+func (h *Hub) remove(sessionID string, t *tunnel) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tunnels[sessionID] == t {
+		delete(h.tunnels, sessionID)
+	}
+}
+
+// Push отправляет сообщение в туннель сессии sessionID.
+func (h *Hub) Push(ctx context.Context, sessionID, message string) error {
+	h.mu.RLock()
+	t, ok := h.tunnels[sessionID]
+	h.mu.RUnlock()
+	if !ok {
+		return ErrTunnelNotFound
+	}
+	return t.send(ctx, message)
+}
+
+// Close закрывает туннель сессии sessionID, например после выхода или отзыва сессии.
+// Закрытие не ждет ответа клиента. Если туннеля нет, Close ничего не делает.
+func (h *Hub) Close(sessionID, reason string) {
+	h.mu.RLock()
+	t, ok := h.tunnels[sessionID]
+	h.mu.RUnlock()
+	if ok {
+		go t.closeSession(reason)
+	}
+}
+
+// Broadcast отправляет сообщение во все открытые туннели.
+func (h *Hub) Broadcast(ctx context.Context, message string) {
+	h.mu.RLock()
+	tunnels := make(map[string]*tunnel, len(h.tunnels))
+	for sessionID, t := range h.tunnels {
+		tunnels[sessionID] = t
+	}
+	h.mu.RUnlock()
+
+	for sessionID, t := range tunnels {
+		if err := t.send(ctx, message); err != nil {
+			slog.Warn("Failed to push message to tunnel", logging.SessionID(sessionID), logging.Error(err))
+		}
+	}
+}
+
+// Shutdown закрывает все открытые туннели со статусом StatusGoingAway,
+// чтобы клиенты узнали об остановке сервера, и перестает принимать новые.
+// Shutdown возвращается только после завершения всех обработчиков туннелей,
+// поэтому после него можно закрыть хранилище. Если ctx истекает раньше,
+// туннели закрываются без рукопожатия, текущие действия отменяются,
+// и после завершения обработчиков возвращается ошибка контекста.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.closed = true
+	tunnels := make([]*tunnel, 0, len(h.tunnels))
+	for _, t := range h.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	h.mu.Unlock()
+
+	for _, t := range tunnels {
+		go t.conn.Close(websocket.StatusGoingAway, "Server is shutting down")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, t := range tunnels {
+			t.cancel()
+			t.conn.CloseNow()
+		}
+		<-done
+		return ctx.Err()
+	}
+}
+
+// TunnelRequest обрабатывает зашифрованный туннель поверх WebSocket.
+// Первым сообщением клиент передает protocol.KeyExchangeRequest в JSON и получает
+// protocol.KeyExchangeResponse, а при ошибке — protocol.ErrorResponse, после
+// которого туннель закрывается. Затем стороны обмениваются двоичными кадрами,
+// зашифрованными ключом доступа сессии.
+// Сессия проверяется перед каждым действием и раз в tunnelCheckInterval; если она
+// больше не действует, туннель закрывается с кодом protocol.TunnelStatusSessionClosed.
+// Действия сверх лимита limiter отклоняются с ошибкой protocol.CodeRateLimited.
+func (pc *PlayController) TunnelRequest(registry *actions.Registry, limiter *ratelimit.Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !pc.tunnels.begin() {
+			wire.Error(w, r, http.StatusServiceUnavailable, protocol.CodeInternal, "Server is shutting down")
+			return
+		}
+		defer pc.tunnels.end()
+
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.CloseNow()
+
+		ctx := r.Context()
+		logger := logging.FromContext(ctx)
+
+		var request protocol.KeyExchangeRequest
+		if err := wsjson.Read(ctx, conn, &request); err != nil {
+			pc.metrics.KeyExchangeFailures.Inc(metrics.ReasonDecode)
+			logger.Warn("Unable to read key exchange request", logging.Error(err))
+			closeWithError(ctx, conn, websocket.StatusPolicyViolation, protocol.NewError(protocol.CodeBadRequest, "Unable to read key exchange request"))
+			return
+		}
+		var versionErr *protocol.Error
+		if errors.As(request.CheckVersion(), &versionErr) {
+			pc.metrics.KeyExchangeFailures.Inc(metrics.ReasonDecode)
+			closeWithError(ctx, conn, websocket.StatusPolicyViolation, versionErr)
+			return
+		}
+
+		exchange, err := pc.createSession(ctx, &request, ratelimit.ClientIP(r))
+		if errors.Is(err, errTooManySessions) {
+			closeWithError(ctx, conn, websocket.StatusTryAgainLater, protocol.NewError(protocol.CodeRateLimited, err.Error()))
+			return
+		}
+		if err != nil {
+			_, code := sessionError(err)
+			closeWithError(ctx, conn, websocket.StatusPolicyViolation, protocol.NewError(code, err.Error()))
+			return
+		}
+
+		if err := wsjson.Write(ctx, conn, pc.keyExchangeResponse(exchange)); err != nil {
+			return
+		}
+
+		sessionID, session := exchange.SessionID, exchange.Session
+		logging.With(ctx, logging.SessionID(sessionID))
+		logger = logging.FromContext(ctx)
+		logger.Info("Tunnel opened", slog.String("key_id", exchange.Keys.ID), slog.String("cipher_suite", string(exchange.CipherSuite)))
+		defer logger.Info("Tunnel closed")
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		t := &tunnel{conn: conn, sessionID: sessionID, session: session, cancel: cancel}
+		if !pc.tunnels.add(sessionID, t) {
+			conn.Close(websocket.StatusGoingAway, "Server is shutting down")
+			return
+		}
+		defer pc.tunnels.remove(sessionID, t)
+
+		// Обработчик не завершается, пока проверка сессии обращается к хранилищу.
+		watched := make(chan struct{})
+		go func() {
+			defer close(watched)
+			pc.watchTunnel(ctx, t)
+		}()
+		defer func() {
+			cancel()
+			<-watched
+		}()
+
+		var sequence uint64
+		for {
+			_, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+
+			sequence++
+			decrypted, err := session.Open(data, t.header(cryptography.ClientToServer, sequence))
+			if err != nil {
+				pc.metrics.DecryptionFailures.Inc("websocket")
+				logger.Warn("Unable to decrypt tunnel message", slog.Uint64("sequence", sequence), logging.Error(err))
+				conn.Close(websocket.StatusInvalidFramePayloadData, "Unable to decrypt data")
+				return
+			}
+
+			current, err := t.validate(pc.sessions, true)
+			if err != nil {
+				logger.Info("Tunnel session is no longer valid", logging.Error(err))
+				t.closeSession("Session is no longer valid")
+				return
+			}
+
+			var response []byte
+			if ok, _ := limiter.Allow(sessionID); ok {
+				pc.touchRoom(ctx, current)
+				response = registry.Dispatch(ctx, sessionID, current, decrypted)
+			} else {
+				response = actions.EncodeError(protocol.NewError(protocol.CodeRateLimited, "Too many actions"))
+			}
+			if err := t.send(ctx, string(response)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// watchTunnel периодически проверяет сессию туннеля t, пока не отменен контекст ctx,
+// и закрывает туннель, если сессия больше не действует.
+func (pc *PlayController) watchTunnel(ctx context.Context, t *tunnel) {
+	ticker := time.NewTicker(tunnelCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := t.validate(pc.sessions, false); err != nil {
+				logging.FromContext(ctx).Info("Tunnel session is no longer valid", logging.Error(err))
+				t.closeSession("Session is no longer valid")
+				return
+			}
+		}
+	}
+}
+
+// closeWithError отправляет клиенту конверт ошибки err и закрывает туннель со статусом status.
+func closeWithError(ctx context.Context, conn *websocket.Conn, status websocket.StatusCode, err *protocol.Error) {
+	if writeErr := wsjson.Write(ctx, conn, protocol.NewErrorResponse(err)); writeErr != nil {
+		conn.CloseNow()
+		return
+	}
+	conn.Close(status, err.Message)
+}
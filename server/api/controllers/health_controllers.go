@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cu/server/api/database"
+	"cu/server/api/logging"
+	"cu/server/api/security"
+	"cu/server/buildinfo"
+)
+
+// healthProbeKey — ключ, который проверка готовности записывает в базу данных.
+const healthProbeKey = "health:probe"
+
+// HealthController обрабатывает запросы балансировщика нагрузки
+// о состоянии сервера и сведения о сборке.
+type HealthController struct {
+	keys *security.ServerKeysStorage
+	db   database.Store
+}
+
+// NewHealthController создает контроллер проверок состояния.
+func NewHealthController(keys *security.ServerKeysStorage, db database.Store) *HealthController {
+	return &HealthController{keys: keys, db: db}
+}
+
+// Healthz сообщает, что процесс сервера запущен и обрабатывает запросы.
+func (hc *HealthController) Healthz(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"Status": "ok"})
+}
+
+// Readyz проверяет, что база данных доступна на запись и ключи сервера загружены.
+// Если хотя бы одна проверка не прошла, отвечает статусом 503.
+func (hc *HealthController) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"Database": "ok",
+		"Keys":     "ok",
+	}
+	status := http.StatusOK
+
+	if err := hc.checkDatabase(); err != nil {
+		logging.FromContext(r.Context()).Error("Readiness check failed", "check", "database", logging.Error(err))
+		checks["Database"] = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	if _, err := hc.keys.Active(); err != nil {
+		logging.FromContext(r.Context()).Error("Readiness check failed", "check", "keys", logging.Error(err))
+		checks["Keys"] = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+
+	result := "ready"
+	if status != http.StatusOK {
+		result = "not ready"
+	}
+	writeJSON(w, status, map[string]any{"Status": result, "Checks": checks})
+}
+
+// Version возвращает сведения о сборке и отпечаток активного публичного ключа сервера.
+func (hc *HealthController) Version(w http.ResponseWriter, r *http.Request) {
+	response := struct {
+		buildinfo.Info
+		KeyID          string `json:"KeyID,omitempty"`
+		KeyFingerprint string `json:"KeyFingerprint,omitempty"`
+	}{Info: buildinfo.Read()}
+
+	if keys, err := hc.keys.Active(); err == nil {
+		response.KeyID = keys.ID
+		response.KeyFingerprint = keys.Fingerprint()
+	} else {
+		logging.FromContext(r.Context()).Warn("Unable to load server keys", logging.Error(err))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// checkDatabase записывает и читает служебный ключ, проверяя, что база доступна на запись.
+func (hc *HealthController) checkDatabase() error {
+	probe := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	return hc.db.Update(func(tx database.Tx) error {
+		if err := tx.Set([]byte(healthProbeKey), probe, time.Minute); err != nil {
+			return err
+		}
+		value, err := tx.Get([]byte(healthProbeKey))
+		if err != nil {
+			return err
+		}
+		if string(value) != string(probe) {
+			return fmt.Errorf("probe mismatch: got %q", value)
+		}
+		return nil
+	})
+}
+
+// writeJSON отвечает статусом status и телом value в формате JSON.
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
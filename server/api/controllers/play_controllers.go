@@ -1,39 +1,66 @@
 package controllers
 
 import (
+	"cmp"
+	"context"
+	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"text/template"
 	"time"
 
 	"cu/common/assets"
 	"cu/common/cryptography"
+	"cu/common/protocol"
+	"cu/server/api/actions"
+	"cu/server/api/database"
+	"cu/server/api/logging"
+	"cu/server/api/metrics"
+	"cu/server/api/ratelimit"
+	"cu/server/api/rooms"
 	"cu/server/api/security"
+	"cu/server/api/wire"
 
-	"github.com/dgraph-io/badger/v4"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
 // PlayController представляет контроллер для обработки запросов.
 type PlayController struct {
-	privateKey [32]byte
-	publicKey  [32]byte
-	sessions   *security.SessionStorage
-	db         *badger.DB
+	keys                 *security.ServerKeysStorage
+	sessions             *security.SessionStorage
+	rooms                *rooms.RoomStorage
+	telegram             *security.TelegramValidator
+	tunnels              *Hub
+	db                   database.Store
+	metrics              *metrics.Server
+	maxSessionsPerClient int
 }
 
 // NewPlayController создает новый контроллер.
-func NewPlayController(privateKey, publicKey [32]byte, db *badger.DB) *PlayController {
+// Если telegram равен nil, initData от клиентов не проверяются и игнорируются.
+// maxSessionsPerClient ограничивает число действующих сессий одного клиента, ноль снимает ограничение.
+func NewPlayController(keys *security.ServerKeysStorage, db database.Store, roomStorage *rooms.RoomStorage, telegram *security.TelegramValidator, serverMetrics *metrics.Server, maxSessionsPerClient int) *PlayController {
 	return &PlayController{
-		privateKey: privateKey,
-		publicKey:  publicKey,
-		sessions:   security.NewSessionStorage(db),
-		db:         db,
+		keys:                 keys,
+		sessions:             security.NewSessionStorage(db),
+		rooms:                roomStorage,
+		telegram:             telegram,
+		tunnels:              NewHub(),
+		db:                   db,
+		metrics:              serverMetrics,
+		maxSessionsPerClient: maxSessionsPerClient,
 	}
 }
 
+// Tunnels возвращает реестр открытых WebSocket-туннелей.
+func (pc *PlayController) Tunnels() *Hub {
+	return pc.tunnels
+}
+
 // PageRequest обрабатывает запрос на отображение страницы.
 func (pc *PlayController) PageRequest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -41,128 +68,359 @@ func (pc *PlayController) PageRequest(w http.ResponseWriter, r *http.Request) {
 
 	tmpl, err := template.ParseFS(assets.TemplateFS, "templates/index.html")
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, http.StatusInternalServerError, protocol.CodeInternal, "Internal Server Error", err)
 		return
 	}
 
 	if err := tmpl.Execute(w, roomID); err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		httpError(w, r, http.StatusInternalServerError, protocol.CodeInternal, "Internal Server Error", err)
 		return
 	}
 }
 
-// KeyExchangeRequest обрабатывает обмен ключами с клиентом.
-func (pc *PlayController) KeyExchangeRequest(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Unable to parse form", http.StatusBadRequest)
-		return
+var (
+	// errInvalidClientKey возвращается, если публичный ключ клиента имеет неверную длину.
+	errInvalidClientKey = errors.New("Invalid ClientPublicKey")
+	// errInvalidInitData возвращается, если initData Telegram не прошли проверку.
+	errInvalidInitData = errors.New("Invalid Telegram InitData")
+	// errTooManySessions возвращается, если у клиента уже максимальное число сессий.
+	errTooManySessions = errors.New("Too many active sessions")
+	// errNoCipherSuite возвращается, если сервер не поддерживает ни один набор шифров клиента.
+	errNoCipherSuite = errors.New("No supported cipher suite")
+)
+
+// sessionLimitRetryAfter — время, через которое клиенту с максимальным числом сессий
+// предлагается повторить обмен ключами.
+const sessionLimitRetryAfter = time.Minute
+
+// keyExchange содержит результат обмена ключами с клиентом.
+type keyExchange struct {
+	// Version — версия протокола, по которой выполнен обмен ключами.
+	Version   int
+	SessionID string
+	Session   *security.ServerSession
+	Keys      *security.ServerKeys
+	// ServerEphemeralKey — эфемерный публичный ключ сервера, если обмен выполнен
+	// начиная с версии protocol.VersionEphemeral.
+	ServerEphemeralKey []byte
+	// CipherSuite — набор шифров сессии.
+	CipherSuite cryptography.CipherSuite
+	// Signature — подпись стенограммы обмена ключами ключом подписи сервера.
+	Signature []byte
+}
+
+// createSession вычисляет ключ доступа по публичному ключу клиента способом,
+// который задает версия запроса, и сохраняет новую сессию клиента clientID
+// (его IP-адреса). Если указана комната, сессия привязывается к ней, а если
+// переданы initData Telegram, к сессии привязывается пользователь Telegram.
+func (pc *PlayController) createSession(ctx context.Context, request *protocol.KeyExchangeRequest, clientID string) (*keyExchange, error) {
+	if len(request.ClientPublicKey) != 32 {
+		return nil, pc.keyExchangeFailed(ctx, metrics.ReasonDecode, errInvalidClientKey, nil)
 	}
 
-	clientPublicKeyHex := r.FormValue("ClientPublicKey")
-	clientPublicKeyBytes, err := hex.DecodeString(clientPublicKeyHex)
-	if err != nil {
-		http.Error(w, "Unable to decode ClientPublicKey", http.StatusBadRequest)
-		return
+	// Клиенты до версии VersionCipherSuites не выбирают набор и шифруют сообщения AES-GCM.
+	suite, prologue := cryptography.AES256GCM, []byte(nil)
+	if request.Version >= protocol.VersionCipherSuites {
+		offered := make([]cryptography.CipherSuite, len(request.CipherSuites))
+		for i, name := range request.CipherSuites {
+			offered[i] = cryptography.CipherSuite(name)
+		}
+		var err error
+		if suite, err = cryptography.NegotiateCipherSuite(offered); err != nil {
+			return nil, pc.keyExchangeFailed(ctx, metrics.ReasonDecode, errNoCipherSuite, err)
+		}
+		prologue = cryptography.NegotiationPrologue(offered)
+	}
+
+	if pc.maxSessionsPerClient > 0 {
+		count, err := pc.sessions.CountClientSessions(clientID)
+		if err != nil {
+			return nil, pc.keyExchangeFailed(ctx, metrics.ReasonStorage, errors.New("Unable to count sessions"), err)
+		}
+		if count >= pc.maxSessionsPerClient {
+			return nil, pc.keyExchangeFailed(ctx, metrics.ReasonTooManySessions, errTooManySessions, nil)
+		}
+	}
+
+	var telegramUserID int64
+	if pc.telegram != nil && request.InitData != "" {
+		user, err := pc.telegram.Validate(request.InitData)
+		if err != nil {
+			return nil, pc.keyExchangeFailed(ctx, metrics.ReasonInitData, errInvalidInitData, err)
+		}
+		telegramUserID = user.ID
 	}
 
 	var clientPublicKey [32]byte
-	copy(clientPublicKey[:], clientPublicKeyBytes)
+	copy(clientPublicKey[:], request.ClientPublicKey)
 
-	baseKey, err := cryptography.ComputeSharedSecret(pc.privateKey, clientPublicKey)
+	serverKeys, err := pc.keys.Active()
 	if err != nil {
-		http.Error(w, "Unable to compute shared secret", http.StatusInternalServerError)
-		return
+		return nil, pc.keyExchangeFailed(ctx, metrics.ReasonServerKeys, errors.New("Unable to load server keys"), err)
 	}
 
 	sessionID := uuid.New().String()
-	sessionKey, err := cryptography.GenerateSessionKey(baseKey[:], sessionID)
+
+	// Подпись стенограммы позволяет клиенту убедиться, что ключи X25519 выданы этим сервером,
+	// а не посредником.
+	identity, err := pc.keys.Identity()
 	if err != nil {
-		http.Error(w, "Unable to generate session key", http.StatusInternalServerError)
-		return
+		return nil, pc.keyExchangeFailed(ctx, metrics.ReasonServerKeys, errors.New("Unable to load server identity key"), err)
+	}
+
+	var sessionKey, transcript, serverEphemeralKey []byte
+	if request.Version == protocol.VersionStaticKey {
+		baseKey, err := cryptography.ComputeSharedSecret(serverKeys.PrivateKey, clientPublicKey)
+		if err != nil {
+			return nil, pc.keyExchangeFailed(ctx, metrics.ReasonSharedSecret, errors.New("Unable to compute shared secret"), err)
+		}
+		sessionKey, err = cryptography.GenerateSessionKey(baseKey[:], sessionID)
+		if err != nil {
+			return nil, pc.keyExchangeFailed(ctx, metrics.ReasonHKDF, errors.New("Unable to generate session key"), err)
+		}
+		transcript = cryptography.HandshakeTranscript(request.ClientPublicKey, serverKeys.PublicKey[:], sessionID)
+	} else {
+		// Эфемерный ключ сервера живет только до конца обмена: без него записанный
+		// трафик не расшифровать даже при утечке статического ключа.
+		ephemeralPrivateKey, ephemeralPublicKey, err := cryptography.GenerateKeyPair()
+		if err != nil {
+			return nil, pc.keyExchangeFailed(ctx, metrics.ReasonSharedSecret, errors.New("Unable to generate ephemeral key"), err)
+		}
+		handshake, err := cryptography.ServerHandshake(prologue, ephemeralPrivateKey, serverKeys.PrivateKey, clientPublicKey, sessionID)
+		if err != nil {
+			return nil, pc.keyExchangeFailed(ctx, metrics.ReasonSharedSecret, errors.New("Unable to complete handshake"), err)
+		}
+		sessionKey, transcript, serverEphemeralKey = handshake.SessionKey, handshake.Hash, ephemeralPublicKey[:]
 	}
+	signature := cryptography.SignTranscript(identity, transcript)
 
 	accessKey, err := cryptography.GenerateAccessKey(sessionKey)
 	if err != nil {
-		http.Error(w, "Unable to generate access key", http.StatusInternalServerError)
-		return
+		return nil, pc.keyExchangeFailed(ctx, metrics.ReasonHKDF, errors.New("Unable to generate access key"), err)
 	}
 
-	pc.sessions.SaveSession(&security.ServerSession{
-		AccessKey: accessKey,
-		LastUsed:  time.Now(),
-		ExpiresAt: time.Now().Add(24 * time.Hour),
-	}, sessionID)
+	session := &security.ServerSession{
+		Version:        request.Version,
+		CipherSuite:    suite,
+		AccessKey:      accessKey,
+		KeyID:          serverKeys.ID,
+		TelegramUserID: telegramUserID,
+		ClientID:       clientID,
+		LastUsed:       time.Now(),
+		ExpiresAt:      time.Now().Add(security.SessionLifetime),
+	}
+	if err := pc.sessions.SaveSession(session, sessionID); err != nil {
+		return nil, pc.keyExchangeFailed(ctx, metrics.ReasonStorage, errors.New("Unable to save session"), err)
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"ServerPublicKey": hex.EncodeToString(pc.publicKey[:]),
-		"SessionID":       sessionID,
-	})
+	if request.RoomID != "" {
+		if _, err := pc.rooms.Bind(sessionID, session, request.RoomID, true); err != nil {
+			pc.sessions.DeleteSession(sessionID)
+			return nil, pc.keyExchangeFailed(ctx, metrics.ReasonRoom, bindError(err), err)
+		}
+	}
+
+	return &keyExchange{
+		Version:            request.Version,
+		SessionID:          sessionID,
+		Session:            session,
+		Keys:               serverKeys,
+		ServerEphemeralKey: serverEphemeralKey,
+		CipherSuite:        suite,
+		Signature:          signature,
+	}, nil
 }
 
-// validateEAPI проверяет валидность EAPI для данной сессии.
-func (pc *PlayController) validateEAPI(sessionID, receivedEAPI string) bool {
-	session, err := pc.sessions.GetSession(sessionID)
-	if err != nil || time.Now().After(session.ExpiresAt) {
-		pc.sessions.DeleteSession(sessionID)
-		return false
+// bindError возвращает ошибку привязки сессии к комнате, которую можно показать клиенту:
+// подробности ошибок хранилища остаются в журнале.
+func bindError(err error) error {
+	for _, public := range []error{rooms.ErrInvalidRoomID, rooms.ErrRoomFull, rooms.ErrRoomNotFound} {
+		if errors.Is(err, public) {
+			return public
+		}
 	}
+	return errors.New("Unable to join room")
+}
 
-	currentTimestamp := time.Now().Unix() / 30
-	expectedEAPI := hex.EncodeToString(cryptography.ComputeEAPI(session.AccessKey, currentTimestamp))
-	previousEAPI := hex.EncodeToString(cryptography.ComputeEAPI(session.AccessKey, currentTimestamp-1))
+// keyExchangeFailed учитывает неудачный обмен ключами по причине reason,
+// записывает в журнал исходную ошибку cause и возвращает ошибку err для клиента.
+func (pc *PlayController) keyExchangeFailed(ctx context.Context, reason string, err, cause error) error {
+	pc.metrics.KeyExchangeFailures.Inc(reason)
+	logging.FromContext(ctx).Warn("Key exchange failed", slog.String("reason", reason), logging.Error(cmp.Or(cause, err)))
+	return err
+}
 
-	if receivedEAPI != expectedEAPI && receivedEAPI != previousEAPI {
-		return false
+// httpError записывает в журнал причину ошибки cause и отвечает клиенту
+// конвертом ошибки с кодом code и текстом message. Клиенту причина не передается.
+func httpError(w http.ResponseWriter, r *http.Request, status int, code, message string, cause error) {
+	level := slog.LevelWarn
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
 	}
+	logging.FromContext(r.Context()).Log(r.Context(), level, message, slog.Int("status", status), logging.Error(cause))
+	wire.Error(w, r, status, code, message)
+}
 
-	session.LastUsed = time.Now()
-	return true
+// sessionError возвращает HTTP-статус и код ошибки протокола для ошибки создания сессии.
+func sessionError(err error) (int, string) {
+	switch {
+	case errors.Is(err, errInvalidClientKey), errors.Is(err, errNoCipherSuite), errors.Is(err, rooms.ErrInvalidRoomID):
+		return http.StatusBadRequest, protocol.CodeBadRequest
+	case errors.Is(err, rooms.ErrRoomFull):
+		return http.StatusConflict, protocol.CodeRoomFull
+	case errors.Is(err, errInvalidInitData):
+		return http.StatusUnauthorized, protocol.CodeInvalidInitData
+	case errors.Is(err, errTooManySessions):
+		return http.StatusTooManyRequests, protocol.CodeRateLimited
+	}
+	return http.StatusInternalServerError, protocol.CodeInternal
+}
+
+// keyExchangeResponse формирует ответ клиенту на обмен ключами.
+func (pc *PlayController) keyExchangeResponse(exchange *keyExchange) protocol.KeyExchangeResponse {
+	return protocol.KeyExchangeResponse{
+		Envelope:           protocol.Envelope{Version: exchange.Version},
+		ServerPublicKey:    exchange.Keys.PublicKey[:],
+		ServerEphemeralKey: exchange.ServerEphemeralKey,
+		CipherSuite:        string(exchange.CipherSuite),
+		KeyID:              exchange.Keys.ID,
+		SessionID:          exchange.SessionID,
+		Signature:          exchange.Signature,
+	}
+}
+
+// KeyExchangeRequest обрабатывает обмен ключами с клиентом.
+func (pc *PlayController) KeyExchangeRequest(w http.ResponseWriter, r *http.Request) {
+	var request protocol.KeyExchangeRequest
+	if !wire.Decode(w, r, &request) {
+		pc.metrics.KeyExchangeFailures.Inc(metrics.ReasonDecode)
+		return
+	}
+
+	exchange, err := pc.createSession(r.Context(), &request, ratelimit.ClientIP(r))
+	if errors.Is(err, errTooManySessions) {
+		ratelimit.WriteTooManyRequests(w, r, sessionLimitRetryAfter)
+		return
+	}
+	if err != nil {
+		status, code := sessionError(err)
+		wire.Error(w, r, status, code, err.Error())
+		return
+	}
+	logging.FromContext(r.Context()).Info("Session created", logging.SessionID(exchange.SessionID), slog.String("key_id", exchange.Keys.ID), slog.Int("version", exchange.Version), slog.String("cipher_suite", string(exchange.CipherSuite)))
+
+	wire.Write(w, r, http.StatusOK, pc.keyExchangeResponse(exchange))
 }
 
 // ActionRequest обрабатывает запросы через защищенный туннель.
-func (pc *PlayController) ActionRequest(callback func(string) string) http.HandlerFunc {
+// Маршрут должен быть защищен middleware аутентификации.
+func (pc *PlayController) ActionRequest(registry *actions.Registry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseForm(); err != nil {
-			http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		identity, ok := security.IdentityFromContext(r.Context())
+		if !ok {
+			wire.Error(w, r, http.StatusUnauthorized, protocol.CodeUnauthorized, "Unauthorized")
 			return
 		}
+		sessionID, session := identity.SessionID, identity.Session
 
-		sessionID := r.FormValue("SessionID")
-		eapi := r.FormValue("EAPI")
-
-		if !pc.validateEAPI(sessionID, eapi) {
-			http.Error(w, "Invalid SessionID or EAPI", http.StatusUnauthorized)
+		var request protocol.ActionRequest
+		if !wire.Decode(w, r, &request) {
 			return
 		}
+		header := cryptography.MessageHeader{SessionID: sessionID, Direction: cryptography.ClientToServer, Type: cryptography.MessageAction, Sequence: request.Seq}
 
-		session, err := pc.sessions.GetSession(sessionID)
+		decrypted, err := session.Open(request.Data, header)
 		if err != nil {
-			http.Error(w, "Invalid SessionID", http.StatusUnauthorized)
+			pc.metrics.DecryptionFailures.Inc("http")
+			httpError(w, r, http.StatusBadRequest, protocol.CodeBadRequest, "Unable to decrypt data", err)
 			return
 		}
 
-		data := r.FormValue("Data")
-
-		decrypted, err := cryptography.DecryptAES(data, session.AccessKey)
-		if err != nil {
-			http.Error(w, "Unable to decrypt data", http.StatusBadRequest)
+		// Номер принимается только после проверки подлинности сообщения,
+		// чтобы поддельный запрос не мог сдвинуть счетчик сессии.
+		if err := pc.sessions.AdvanceSequence(sessionID, request.Seq); err != nil {
+			if errors.Is(err, security.ErrReplayedSequence) {
+				httpError(w, r, http.StatusConflict, protocol.CodeReplayedSequence, "Replayed Seq", err)
+				return
+			}
+			httpError(w, r, http.StatusInternalServerError, protocol.CodeInternal, "Unable to update session", err)
 			return
 		}
 
-		decryptedString := string(decrypted)
-
-		response := callback(decryptedString)
+		pc.touchRoom(r.Context(), session)
+		response := registry.Dispatch(r.Context(), sessionID, session, decrypted)
 
-		encrypted, err := cryptography.EncryptAES([]byte(response), session.AccessKey)
+		header.Direction = cryptography.ServerToClient
+		encrypted, err := session.Seal(response, header)
 		if err != nil {
-			http.Error(w, "Unable to encrypt response", http.StatusInternalServerError)
+			httpError(w, r, http.StatusInternalServerError, protocol.CodeInternal, "Unable to encrypt response", err)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"Data": string(encrypted)})
+		wire.Write(w, r, http.StatusOK, protocol.ActionResponse{Envelope: protocol.NewEnvelope(), Data: encrypted})
+	}
+}
+
+// touchRoom продлевает срок жизни комнаты, в которой находится сессия session.
+// Ошибка не прерывает действие: комнату, которая уже истекла, обработчик действия
+// обнаружит сам.
+func (pc *PlayController) touchRoom(ctx context.Context, session *security.ServerSession) {
+	if session.RoomID == "" {
+		return
 	}
+	if err := pc.rooms.Touch(session.RoomID); err != nil && !errors.Is(err, rooms.ErrRoomNotFound) {
+		logging.FromContext(ctx).Warn("Unable to touch room", slog.String("room_id", session.RoomID), logging.Error(err))
+	}
+}
+
+// LogoutRequest завершает сессию клиента и выводит ее из комнаты.
+// Маршрут должен быть защищен middleware аутентификации.
+func (pc *PlayController) LogoutRequest(w http.ResponseWriter, r *http.Request) {
+	identity, ok := security.IdentityFromContext(r.Context())
+	if !ok {
+		wire.Error(w, r, http.StatusUnauthorized, protocol.CodeUnauthorized, "Unauthorized")
+		return
+	}
+	sessionID, session := identity.SessionID, identity.Session
+
+	if err := pc.rooms.Unbind(sessionID, session); err != nil {
+		httpError(w, r, http.StatusInternalServerError, protocol.CodeInternal, "Unable to leave room", err)
+		return
+	}
+
+	if err := pc.sessions.DeleteSession(sessionID); err != nil {
+		httpError(w, r, http.StatusInternalServerError, protocol.CodeInternal, "Unable to delete session", err)
+		return
+	}
+	pc.tunnels.Close(sessionID, "Session closed")
+	logging.FromContext(r.Context()).Info("Session closed")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RefreshSession обрабатывает действие обновления ключа доступа.
+// Новый ключ выводится из текущего и случайного nonce, который возвращается клиенту.
+// Ответ на действие шифруется еще прежним ключом. Туннель сессии, зашифрованный
+// прежним ключом, закрывается.
+func (pc *PlayController) RefreshSession(_ context.Context, req *actions.Request) (any, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	accessKey, err := cryptography.RefreshAccessKey(req.Session.AccessKey, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh access key: %w", err)
+	}
+
+	_, err = pc.sessions.UpdateSession(req.SessionID, func(session *security.ServerSession) error {
+		session.AccessKey = accessKey
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save session: %w", err)
+	}
+	pc.tunnels.Close(req.SessionID, "Access key refreshed")
+
+	return map[string]string{"Nonce": hex.EncodeToString(nonce)}, nil
 }
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cu/common/cryptography"
+	"cu/common/protocol"
+	"cu/server/api/database"
+	"cu/server/api/metrics"
+	"cu/server/api/rooms"
+	"cu/server/api/security"
+)
+
+// newTestController создает контроллер с хранилищем Badger и активным ключом сервера.
+func newTestController(t *testing.T, maxSessionsPerClient int) (*PlayController, *metrics.Server) {
+	t.Helper()
+	store, err := database.Open("badger", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	keys, err := security.NewServerKeysStorage(store, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Rotate(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	serverMetrics := metrics.NewServer()
+	roomStorage := rooms.NewRoomStorage(store, 8, time.Hour)
+	return NewPlayController(keys, store, roomStorage, nil, serverMetrics, maxSessionsPerClient), serverMetrics
+}
+
+// newKeyExchangeRequest возвращает запрос на обмен ключами текущей версии протокола.
+func newKeyExchangeRequest(t *testing.T) *protocol.KeyExchangeRequest {
+	t.Helper()
+	_, publicKey, err := cryptography.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &protocol.KeyExchangeRequest{
+		Envelope:        protocol.NewEnvelope(),
+		ClientPublicKey: publicKey[:],
+		CipherSuites:    []string{string(cryptography.XChaCha20Poly1305)},
+	}
+}
+
+func TestCreateSessionLimitsSessionsPerClient(t *testing.T) {
+	pc, serverMetrics := newTestController(t, 2)
+	ctx := context.Background()
+
+	var sessionIDs []string
+	for range 2 {
+		exchange, err := pc.createSession(ctx, newKeyExchangeRequest(t), "198.51.100.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessionIDs = append(sessionIDs, exchange.SessionID)
+	}
+	if _, err := pc.createSession(ctx, newKeyExchangeRequest(t), "198.51.100.1"); !errors.Is(err, errTooManySessions) {
+		t.Fatalf("createSession over the limit returned %v, want errTooManySessions", err)
+	}
+	if _, err := pc.createSession(ctx, newKeyExchangeRequest(t), "198.51.100.2"); err != nil {
+		t.Fatalf("limit of one client affected another: %v", err)
+	}
+
+	// Завершенная сессия освобождает место.
+	if err := pc.sessions.DeleteSession(sessionIDs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.createSession(ctx, newKeyExchangeRequest(t), "198.51.100.1"); err != nil {
+		t.Fatalf("createSession after logout returned %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	serverMetrics.Registry.Handler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `cu_key_exchange_failures_total{reason="too_many_sessions"} 1`; !strings.Contains(recorder.Body.String(), want) {
+		t.Fatalf("metrics do not contain %s:\n%s", want, recorder.Body.String())
+	}
+}
+
+func TestCreateSessionWithoutLimit(t *testing.T) {
+	pc, _ := newTestController(t, 0)
+	for range 3 {
+		if _, err := pc.createSession(context.Background(), newKeyExchangeRequest(t), "198.51.100.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -1,9 +1,119 @@
 package database
 
 import (
+	"errors"
+	"time"
+
 	"github.com/dgraph-io/badger/v4"
 )
 
-func NewBadgerDB() (*badger.DB, error) {
-	return badger.Open(badger.DefaultOptions("./data"))
+// NewBadgerDB открывает базу данных Badger в каталоге path.
+func NewBadgerDB(path string) (*badger.DB, error) {
+	return badger.Open(badger.DefaultOptions(path))
+}
+
+// BadgerStore реализует Store поверх Badger.
+type BadgerStore struct {
+	db *badger.DB
+}
+
+// NewBadgerStore создает хранилище поверх открытой базы db.
+func NewBadgerStore(db *badger.DB) *BadgerStore {
+	return &BadgerStore{db: db}
+}
+
+// DB возвращает базу Badger для операций, специфичных для Badger.
+func (s *BadgerStore) DB() *badger.DB {
+	return s.db
+}
+
+// View выполняет fn в транзакции только для чтения.
+func (s *BadgerStore) View(fn func(tx Tx) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		return fn(badgerTx{txn: txn})
+	})
+}
+
+// Update выполняет fn в транзакции на чтение и запись.
+func (s *BadgerStore) Update(fn func(tx Tx) error) error {
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerTx{txn: txn})
+	})
+	if errors.Is(err, badger.ErrConflict) {
+		return ErrConflict
+	}
+	return err
+}
+
+// Close закрывает базу Badger.
+func (s *BadgerStore) Close() error {
+	return s.db.Close()
+}
+
+// CollectGarbage запускает сборку мусора в журнале значений Badger,
+// пока она освобождает место.
+func (s *BadgerStore) CollectGarbage() error {
+	for {
+		err := s.db.RunValueLogGC(0.5)
+		if errors.Is(err, badger.ErrNoRewrite) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Size возвращает суммарный размер LSM-дерева и журнала значений.
+func (s *BadgerStore) Size() (int64, error) {
+	lsm, vlog := s.db.Size()
+	return lsm + vlog, nil
+}
+
+// badgerTx адаптирует транзакцию Badger к интерфейсу Tx.
+type badgerTx struct {
+	txn *badger.Txn
+}
+
+func (t badgerTx) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTx) Set(key, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		return t.Delete(key)
+	}
+	entry := badger.NewEntry(key, value)
+	if ttl > 0 {
+		entry = entry.WithTTL(ttl)
+	}
+	return t.txn.SetEntry(entry)
+}
+
+func (t badgerTx) Delete(key []byte) error {
+	return t.txn.Delete(key)
+}
+
+func (t badgerTx) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	it := t.txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true, PrefetchSize: 100})
+	defer it.Close()
+
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(item.KeyCopy(nil), value); err != nil {
+			return err
+		}
+	}
+	return nil
 }
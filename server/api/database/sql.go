@@ -0,0 +1,202 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// Dialect описывает различия SQL-баз, поддерживаемых SQLStore.
+type Dialect struct {
+	// Driver — имя драйвера database/sql.
+	Driver string
+	// Schema создает таблицу для пар ключ-значение.
+	Schema string
+	// LockSuffix добавляется к чтению внутри Update, чтобы заблокировать строку.
+	LockSuffix string
+	// MaxOpenConns ограничивает число соединений. Ноль означает отсутствие ограничения.
+	MaxOpenConns int
+}
+
+var (
+	// Postgres — диалект PostgreSQL.
+	Postgres = Dialect{
+		Driver: "postgres",
+		Schema: `CREATE TABLE IF NOT EXISTS kv (
+			key BYTEA PRIMARY KEY,
+			value BYTEA NOT NULL,
+			expires_at BIGINT NOT NULL DEFAULT 0
+		)`,
+		LockSuffix: " FOR UPDATE",
+	}
+	// SQLite — диалект встроенной базы SQLite.
+	// SQLite допускает только одного писателя, поэтому соединение одно.
+	SQLite = Dialect{
+		Driver: "sqlite",
+		Schema: `CREATE TABLE IF NOT EXISTS kv (
+			key BLOB PRIMARY KEY,
+			value BLOB NOT NULL,
+			expires_at INTEGER NOT NULL DEFAULT 0
+		)`,
+		MaxOpenConns: 1,
+	}
+)
+
+// SQLStore реализует Store поверх SQL-базы.
+// Записи хранятся в таблице kv, срок жизни — в expires_at (наносекунды Unix, 0 — бессрочно).
+type SQLStore struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// OpenSQL подключается к базе dsn с диалектом dialect и создает таблицу, если ее нет.
+func OpenSQL(dialect Dialect, dsn string) (*SQLStore, error) {
+	db, err := sql.Open(dialect.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(dialect.MaxOpenConns)
+	}
+
+	if _, err := db.Exec(dialect.Schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create schema: %w", err)
+	}
+
+	return &SQLStore{db: db, dialect: dialect}, nil
+}
+
+// View выполняет fn в транзакции только для чтения.
+func (s *SQLStore) View(fn func(tx Tx) error) error {
+	return s.transaction(&sql.TxOptions{ReadOnly: true}, "", fn)
+}
+
+// Update выполняет fn в транзакции на чтение и запись.
+func (s *SQLStore) Update(fn func(tx Tx) error) error {
+	return s.transaction(nil, s.dialect.LockSuffix, fn)
+}
+
+// Close закрывает подключение к базе.
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// CollectGarbage удаляет истекшие записи.
+func (s *SQLStore) CollectGarbage() error {
+	_, err := s.db.Exec(`DELETE FROM kv WHERE expires_at <> 0 AND expires_at <= $1`, time.Now().UnixNano())
+	return err
+}
+
+// Size возвращает суммарный объем ключей и значений.
+func (s *SQLStore) Size() (int64, error) {
+	var size sql.NullInt64
+	err := s.db.QueryRow(`SELECT SUM(LENGTH(key) + LENGTH(value)) FROM kv`).Scan(&size)
+	return size.Int64, err
+}
+
+// transaction выполняет fn в транзакции и фиксирует ее, если fn завершилась без ошибки.
+func (s *SQLStore) transaction(opts *sql.TxOptions, lockSuffix string, fn func(tx Tx) error) error {
+	tx, err := s.db.BeginTx(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&sqlTx{tx: tx, lockSuffix: lockSuffix}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlTx адаптирует транзакцию database/sql к интерфейсу Tx.
+type sqlTx struct {
+	tx         *sql.Tx
+	lockSuffix string
+}
+
+func (t *sqlTx) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := t.tx.QueryRow(
+		`SELECT value FROM kv WHERE key = $1 AND (expires_at = 0 OR expires_at > $2)`+t.lockSuffix,
+		key, time.Now().UnixNano(),
+	).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrKeyNotFound
+	}
+	return value, err
+}
+
+func (t *sqlTx) Set(key, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		return t.Delete(key)
+	}
+
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl).UnixNano()
+	}
+	_, err := t.tx.Exec(
+		`INSERT INTO kv (key, value, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+		key, value, expiresAt,
+	)
+	return err
+}
+
+func (t *sqlTx) Delete(key []byte) error {
+	_, err := t.tx.Exec(`DELETE FROM kv WHERE key = $1`, key)
+	return err
+}
+
+func (t *sqlTx) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	// nil передается в запрос как NULL, с которым не совпадает ни один ключ.
+	if prefix == nil {
+		prefix = []byte{}
+	}
+	query := `SELECT key, value FROM kv WHERE key >= $1 AND (expires_at = 0 OR expires_at > $2)`
+	args := []any{prefix, time.Now().UnixNano()}
+	if end := prefixEnd(prefix); end != nil {
+		query += ` AND key < $3`
+		args = append(args, end)
+	}
+
+	rows, err := t.tx.Query(query+` ORDER BY key`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// prefixEnd возвращает наименьший ключ, больший всех ключей с префиксом prefix.
+// Для префикса из одних байтов 0xff верхней границы нет, и возвращается nil.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
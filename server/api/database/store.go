@@ -0,0 +1,71 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrKeyNotFound возвращается, если ключ отсутствует или срок его жизни истек.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrConflict возвращается Update, если прочитанные транзакцией ключи изменила
+	// параллельная транзакция. Изменения отменяются, и транзакцию можно повторить.
+	ErrConflict = errors.New("transaction conflict")
+)
+
+// Store — транзакционное key-value хранилище с ограничением срока жизни записей.
+// На нем построены хранилища сессий, ключей сервера и комнат.
+type Store interface {
+	// View выполняет fn в транзакции только для чтения.
+	View(fn func(tx Tx) error) error
+	// Update выполняет fn в транзакции на чтение и запись.
+	// Если fn возвращает ошибку, изменения отменяются. Конфликт с параллельной
+	// транзакцией возвращается как ErrConflict.
+	Update(fn func(tx Tx) error) error
+	// Close закрывает хранилище.
+	Close() error
+}
+
+// Tx — транзакция хранилища.
+type Tx interface {
+	// Get возвращает значение ключа или ErrKeyNotFound.
+	Get(key []byte) ([]byte, error)
+	// Set сохраняет значение. Если ttl больше нуля, запись удаляется по его истечении,
+	// нулевой ttl означает бессрочную запись, а отрицательный — уже истекшую.
+	Set(key, value []byte, ttl time.Duration) error
+	// Delete удаляет ключ. Удаление отсутствующего ключа не является ошибкой.
+	Delete(key []byte) error
+	// Scan вызывает fn для всех ключей с префиксом prefix в порядке возрастания.
+	Scan(prefix []byte, fn func(key, value []byte) error) error
+}
+
+// GarbageCollector реализуется хранилищами, которым нужна периодическая очистка.
+type GarbageCollector interface {
+	// CollectGarbage освобождает место, занятое удаленными и истекшими записями.
+	CollectGarbage() error
+}
+
+// Sizer реализуется хранилищами, которые могут сообщить занимаемый объем.
+type Sizer interface {
+	// Size возвращает размер хранилища в байтах.
+	Size() (int64, error)
+}
+
+// Open открывает хранилище с драйвером driver.
+// Для "badger" и "sqlite" dsn — путь к данным, для "postgres" — строка подключения.
+func Open(driver, dsn string) (Store, error) {
+	switch driver {
+	case "", "badger":
+		db, err := NewBadgerDB(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return NewBadgerStore(db), nil
+	case "postgres":
+		return OpenSQL(Postgres, dsn)
+	case "sqlite":
+		return OpenSQL(SQLite, dsn)
+	}
+	return nil, fmt.Errorf("unsupported database driver %q", driver)
+}
@@ -0,0 +1,252 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// drivers перечисляет хранилища, которые проверяются набором conformanceTests.
+// Postgres требует запущенного сервера и здесь не проверяется.
+var drivers = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"badger", func(t *testing.T) Store {
+		store, err := Open("badger", t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+	{"sqlite", func(t *testing.T) Store {
+		store, err := Open("sqlite", filepath.Join(t.TempDir(), "store.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+}
+
+// conformanceTests описывают поведение, общее для всех реализаций Store.
+var conformanceTests = []struct {
+	name string
+	run  func(t *testing.T, store Store)
+}{
+	{"GetMissing", func(t *testing.T, store Store) {
+		err := store.View(func(tx Tx) error {
+			_, err := tx.Get([]byte("missing"))
+			return err
+		})
+		if !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get of a missing key returned %v, want ErrKeyNotFound", err)
+		}
+	}},
+	{"SetGet", func(t *testing.T, store Store) {
+		mustSet(t, store, "key", "first", 0)
+		mustSet(t, store, "key", "second", 0)
+		if value := mustGet(t, store, "key"); value != "second" {
+			t.Fatalf("Get returned %q, want %q", value, "second")
+		}
+	}},
+	{"Delete", func(t *testing.T, store Store) {
+		mustSet(t, store, "key", "value", 0)
+		err := store.Update(func(tx Tx) error {
+			if err := tx.Delete([]byte("key")); err != nil {
+				return err
+			}
+			return tx.Delete([]byte("missing"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := get(store, "key"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get after Delete returned %v, want ErrKeyNotFound", err)
+		}
+	}},
+	{"ScanPrefix", func(t *testing.T, store Store) {
+		for _, key := range []string{"b:2", "a:1", "b:1", "b", "c:1", "b:10"} {
+			mustSet(t, store, key, "value:"+key, 0)
+		}
+		var keys, values []string
+		err := store.View(func(tx Tx) error {
+			return tx.Scan([]byte("b:"), func(key, value []byte) error {
+				keys = append(keys, string(key))
+				values = append(values, string(value))
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"b:1", "b:10", "b:2"}; !reflect.DeepEqual(keys, want) {
+			t.Fatalf("Scan returned keys %q, want %q", keys, want)
+		}
+		if want := []string{"value:b:1", "value:b:10", "value:b:2"}; !reflect.DeepEqual(values, want) {
+			t.Fatalf("Scan returned values %q, want %q", values, want)
+		}
+	}},
+	{"ScanStop", func(t *testing.T, store Store) {
+		mustSet(t, store, "a:1", "1", 0)
+		mustSet(t, store, "a:2", "2", 0)
+		stop := errors.New("stop")
+		calls := 0
+		err := store.View(func(tx Tx) error {
+			return tx.Scan([]byte("a:"), func(_, _ []byte) error {
+				calls++
+				return stop
+			})
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Fatalf("Scan returned %v after %d calls, want the callback error after 1 call", err, calls)
+		}
+	}},
+	{"TTLExpiry", func(t *testing.T, store Store) {
+		mustSet(t, store, "expired", "value", -time.Second)
+		mustSet(t, store, "short", "value", time.Second)
+		mustSet(t, store, "long", "value", time.Hour)
+		mustSet(t, store, "forever", "value", 0)
+		if _, err := get(store, "expired"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get of a key with a negative TTL returned %v, want ErrKeyNotFound", err)
+		}
+
+		// Badger хранит срок жизни с точностью до секунды.
+		time.Sleep(2 * time.Second)
+		if _, err := get(store, "short"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get of an expired key returned %v, want ErrKeyNotFound", err)
+		}
+		var keys []string
+		err := store.View(func(tx Tx) error {
+			return tx.Scan(nil, func(key, _ []byte) error {
+				keys = append(keys, string(key))
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"forever", "long"}; !reflect.DeepEqual(keys, want) {
+			t.Fatalf("Scan returned keys %q, want %q", keys, want)
+		}
+	}},
+	{"TxRollback", func(t *testing.T, store Store) {
+		mustSet(t, store, "kept", "before", 0)
+		mustSet(t, store, "deleted", "before", 0)
+		abort := errors.New("abort")
+		err := store.Update(func(tx Tx) error {
+			if err := tx.Set([]byte("kept"), []byte("after"), 0); err != nil {
+				return err
+			}
+			if err := tx.Set([]byte("added"), []byte("after"), 0); err != nil {
+				return err
+			}
+			if err := tx.Delete([]byte("deleted")); err != nil {
+				return err
+			}
+			return abort
+		})
+		if !errors.Is(err, abort) {
+			t.Fatalf("Update returned %v, want the callback error", err)
+		}
+		if value := mustGet(t, store, "kept"); value != "before" {
+			t.Fatalf("rolled back Set left %q, want %q", value, "before")
+		}
+		if value := mustGet(t, store, "deleted"); value != "before" {
+			t.Fatalf("rolled back Delete left %q, want %q", value, "before")
+		}
+		if _, err := get(store, "added"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get of a rolled back key returned %v, want ErrKeyNotFound", err)
+		}
+	}},
+	{"TxReadsOwnWrites", func(t *testing.T, store Store) {
+		err := store.Update(func(tx Tx) error {
+			if err := tx.Set([]byte("key"), []byte("value"), 0); err != nil {
+				return err
+			}
+			value, err := tx.Get([]byte("key"))
+			if err != nil {
+				return err
+			}
+			if string(value) != "value" {
+				t.Errorf("Get in the same transaction returned %q, want %q", value, "value")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}},
+}
+
+func TestStoreConformance(t *testing.T) {
+	for _, driver := range drivers {
+		t.Run(driver.name, func(t *testing.T) {
+			for _, test := range conformanceTests {
+				t.Run(test.name, func(t *testing.T) {
+					t.Parallel()
+					store := driver.open(t)
+					t.Cleanup(func() {
+						if err := store.Close(); err != nil {
+							t.Error(err)
+						}
+					})
+					test.run(t, store)
+				})
+			}
+		})
+	}
+}
+
+func get(store Store, key string) (string, error) {
+	var value []byte
+	err := store.View(func(tx Tx) error {
+		var err error
+		value, err = tx.Get([]byte(key))
+		return err
+	})
+	return string(value), err
+}
+
+func mustGet(t *testing.T, store Store, key string) string {
+	t.Helper()
+	value, err := get(store, key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	return value
+}
+
+func mustSet(t *testing.T, store Store, key, value string, ttl time.Duration) {
+	t.Helper()
+	err := store.Update(func(tx Tx) error {
+		return tx.Set([]byte(key), []byte(value), ttl)
+	})
+	if err != nil {
+		t.Fatalf("Set(%q): %v", key, err)
+	}
+}
+
+// TestBadgerConflict проверяет, что конфликт параллельных транзакций Badger
+// возвращается как ErrConflict. SQL-хранилища блокируют прочитанные строки
+// и конфликтов не возвращают.
+func TestBadgerConflict(t *testing.T) {
+	store := drivers[0].open(t)
+	defer store.Close()
+	mustSet(t, store, "key", "first", 0)
+
+	err := store.Update(func(tx Tx) error {
+		if _, err := tx.Get([]byte("key")); err != nil {
+			return err
+		}
+		mustSet(t, store, "key", "concurrent", 0)
+		return tx.Set([]byte("key"), []byte("second"), 0)
+	})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("Update returned %v, want ErrConflict", err)
+	}
+	if value := mustGet(t, store, "key"); value != "concurrent" {
+		t.Fatalf("Get returned %q, want %q", value, "concurrent")
+	}
+}
@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+)
+
+// RequestIDHeader — заголовок, в котором сервер возвращает идентификатор запроса.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength ограничивает длину идентификатора запроса, переданного клиентом.
+const maxRequestIDLength = 64
+
+type loggerKey struct{}
+
+// requestLogger хранит логгер запроса. Хранение по указателю позволяет
+// обработчикам дополнять логгер атрибутами, видимыми middleware выше по цепочке.
+type requestLogger struct {
+	logger *slog.Logger
+}
+
+// New создает логгер, который пишет записи в формате JSON в w.
+func New(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// WithLogger возвращает контекст с логгером запроса logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, &requestLogger{logger: logger})
+}
+
+// FromContext возвращает логгер запроса из контекста ctx или логгер по умолчанию.
+func FromContext(ctx context.Context) *slog.Logger {
+	if rl, ok := ctx.Value(loggerKey{}).(*requestLogger); ok {
+		return rl.logger
+	}
+	return slog.Default()
+}
+
+// With дополняет логгер запроса из контекста ctx атрибутами args.
+// Атрибуты попадают во все последующие записи запроса, включая итоговую.
+// Если в контексте нет логгера запроса, вызов ничего не делает.
+func With(ctx context.Context, args ...any) {
+	if rl, ok := ctx.Value(loggerKey{}).(*requestLogger); ok {
+		rl.logger = rl.logger.With(args...)
+	}
+}
+
+// NewRequestID генерирует случайный идентификатор запроса.
+func NewRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// ValidRequestID сообщает, можно ли использовать идентификатор запроса, переданный клиентом.
+// Допускаются только латинские буквы, цифры, дефис и подчеркивание,
+// чтобы клиент не мог подделать записи журнала.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SessionID возвращает атрибут с обезличенным идентификатором сессии.
+// Идентификатор сессии вместе с EAPI дает доступ к сессии, поэтому в журнал
+// попадает только префикс его хеша, достаточный для сопоставления записей.
+func SessionID(id string) slog.Attr {
+	if id == "" {
+		return slog.String("session", "")
+	}
+	sum := sha256.Sum256([]byte(id))
+	return slog.String("session", hex.EncodeToString(sum[:6]))
+}
+
+// Error возвращает атрибут с ошибкой err.
+func Error(err error) slog.Attr {
+	return slog.Any("error", err)
+}
@@ -0,0 +1,281 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cu/server/api/logging"
+)
+
+// DefaultBuckets — границы гистограммы длительности запросов в секундах.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// collector выводит метрику в текстовом формате Prometheus.
+type collector interface {
+	name() string
+	write(w io.Writer) error
+}
+
+// Registry хранит метрики и отдает их в текстовом формате Prometheus.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry создает пустой реестр метрик.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register добавляет метрику в реестр.
+// Повторная регистрация имени — ошибка программиста, поэтому вызывает панику.
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.collectors {
+		if existing.name() == c.name() {
+			panic("metrics: duplicate metric " + c.name())
+		}
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+// NewCounterVec регистрирует счетчик с метками labels.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{metric: name, help: help, labels: labels}, values: make(map[string]*series)}
+	r.register(c)
+	return c
+}
+
+// NewHistogramVec регистрирует гистограмму с границами buckets и метками labels.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{metric: name, help: help, labels: labels},
+		buckets: slices.Sorted(slices.Values(buckets)),
+		values:  make(map[string]*histogram),
+	}
+	r.register(h)
+	return h
+}
+
+// NewGaugeFunc регистрирует показатель, значение которого вычисляется функцией fn при каждом запросе метрик.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() (float64, error)) {
+	r.register(&gaugeFunc{desc: desc{metric: name, help: help}, fn: fn})
+}
+
+// Handler отдает все метрики реестра в текстовом формате Prometheus.
+func (r *Registry) Handler(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			slog.Error("Failed to write metric", slog.String("metric", c.name()), logging.Error(err))
+		}
+	}
+}
+
+// desc описывает имя, справку и метки метрики.
+type desc struct {
+	metric string
+	help   string
+	labels []string
+}
+
+func (d desc) name() string {
+	return d.metric
+}
+
+// header записывает строки HELP и TYPE метрики.
+func (d desc) header(w io.Writer, kind string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metric, helpEscaper.Replace(d.help), d.metric, kind)
+	return err
+}
+
+// Текстовый формат Prometheus экранирует в справке только обратную косую черту
+// и перевод строки, а в значениях меток — еще и кавычки. Остальные символы,
+// в том числе не-ASCII, записываются как есть в UTF-8.
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// quoteLabelValue заключает значение метки в кавычки с экранированием по правилам Prometheus.
+func quoteLabelValue(value string) string {
+	return `"` + labelValueEscaper.Replace(value) + `"`
+}
+
+// key объединяет значения меток в ключ серии.
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.metric, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs форматирует метки серии и дополнительные пары extra в виде {name="value",...}.
+func (d desc) labelPairs(values []string, extra ...string) string {
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, value := range values {
+		pairs = append(pairs, d.labels[i]+"="+quoteLabelValue(value))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+quoteLabelValue(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// series хранит значение одной серии счетчика.
+type series struct {
+	labels []string
+	value  float64
+}
+
+// CounterVec — монотонно растущий счетчик, разделенный по значениям меток.
+type CounterVec struct {
+	desc
+
+	mu     sync.Mutex
+	values map[string]*series
+}
+
+// Add увеличивает счетчик серии с метками labels на delta.
+func (c *CounterVec) Add(delta float64, labels ...string) {
+	key := c.key(labels)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &series{labels: slices.Clone(labels)}
+		c.values[key] = s
+	}
+	s.value += delta
+}
+
+// Inc увеличивает счетчик серии с метками labels на единицу.
+func (c *CounterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	if err := c.header(w, "counter"); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range slices.Sorted(maps.Keys(c.values)) {
+		s := c.values[key]
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.metric, c.labelPairs(s.labels), formatFloat(s.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// histogram хранит наблюдения одной серии гистограммы.
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec — гистограмма наблюдений, разделенная по значениям меток.
+type HistogramVec struct {
+	desc
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+// Observe добавляет наблюдение value в серию с метками labels.
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	key := h.key(labels)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogram{labels: slices.Clone(labels), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	if err := h.header(w, "histogram"); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range slices.Sorted(maps.Keys(h.values)) {
+		s := h.values[key]
+		for i, bound := range h.buckets {
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.metric, h.labelPairs(s.labels, "le", formatFloat(bound)), s.counts[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.metric, h.labelPairs(s.labels, "le", "+Inf"), s.count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", h.metric, h.labelPairs(s.labels), formatFloat(s.sum)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_count%s %d\n", h.metric, h.labelPairs(s.labels), s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gaugeFunc — показатель, вычисляемый при каждом запросе метрик.
+type gaugeFunc struct {
+	desc
+	fn func() (float64, error)
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	value, err := g.fn()
+	if err != nil {
+		return err
+	}
+	if err := g.header(w, "gauge"); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s %s\n", g.metric, formatFloat(value))
+	return err
+}
+
+// formatFloat форматирует число так, как этого ожидает Prometheus.
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
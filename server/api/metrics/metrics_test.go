@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+// scrape возвращает метрики реестра в текстовом формате.
+func scrape(t *testing.T, registry *Registry) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	registry.Handler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if got := recorder.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Fatalf("Content-Type is %q", got)
+	}
+	return recorder.Body.String()
+}
+
+func TestCounterExposition(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounterVec("test_total", "Total number of tests.", "route", "status")
+	counter.Inc("/b", "200")
+	counter.Add(2.5, "/a", "500")
+	counter.Inc("/a", "500")
+
+	want := `# HELP test_total Total number of tests.
+# TYPE test_total counter
+test_total{route="/a",status="500"} 3.5
+test_total{route="/b",status="200"} 1
+`
+	if got := scrape(t, registry); got != want {
+		t.Fatalf("exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLabelValueEscaping(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounterVec("escape_total", "Help with \\ and\nnewline.", "value")
+	counter.Inc("комната")
+	counter.Inc("🎲 \"quoted\" \\path\nline")
+
+	// Не-ASCII символы записываются как есть; экранируются только \, " и перевод строки.
+	want := `# HELP escape_total Help with \\ and\nnewline.
+# TYPE escape_total counter
+escape_total{value="комната"} 1
+escape_total{value="🎲 \"quoted\" \\path\nline"} 1
+`
+	if got := scrape(t, registry); got != want {
+		t.Fatalf("exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	registry := NewRegistry()
+	histogram := registry.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 0.1}, "route")
+	histogram.Observe(0.05, "/a")
+	histogram.Observe(0.5, "/a")
+	histogram.Observe(5, "/a")
+
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 1
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 5.55
+latency_seconds_count{route="/a"} 3
+`
+	if got := scrape(t, registry); got != want {
+		t.Fatalf("exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGaugeFuncExposition(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewGaugeFunc("broken", "Broken gauge.", func() (float64, error) {
+		return 0, errors.New("unavailable")
+	})
+	registry.NewGaugeFunc("rooms", "Open rooms.", func() (float64, error) {
+		return 7, nil
+	})
+
+	// Показатель, который не удалось вычислить, пропускается целиком.
+	want := `# HELP rooms Open rooms.
+# TYPE rooms gauge
+rooms 7
+`
+	if got := scrape(t, registry); got != want {
+		t.Fatalf("exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegistryPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(registry *Registry)
+	}{
+		{"DuplicateName", func(registry *Registry) {
+			registry.NewCounterVec("dup_total", "Help.")
+			registry.NewCounterVec("dup_total", "Help.")
+		}},
+		{"LabelCountMismatch", func(registry *Registry) {
+			registry.NewCounterVec("labels_total", "Help.", "a", "b").Inc("a")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected a panic")
+				}
+			}()
+			test.fn(NewRegistry())
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package metrics
+
+// Причины неудачного обмена ключами для метки reason.
+const (
+	ReasonDecode          = "decode"
+	ReasonSharedSecret    = "shared_secret"
+	ReasonHKDF            = "hkdf"
+	ReasonServerKeys      = "server_keys"
+	ReasonInitData        = "init_data"
+	ReasonStorage         = "storage"
+	ReasonRoom            = "room"
+	ReasonTooManySessions = "too_many_sessions"
+)
+
+// Server содержит метрики игрового сервера.
+type Server struct {
+	Registry *Registry
+
+	// Requests считает HTTP-запросы по маршруту, методу и статусу ответа.
+	Requests *CounterVec
+	// RequestDuration измеряет длительность HTTP-запросов по маршруту и методу.
+	RequestDuration *HistogramVec
+	// KeyExchangeFailures считает неудачные обмены ключами по причине.
+	KeyExchangeFailures *CounterVec
+	// DecryptionFailures считает сообщения, которые не удалось расшифровать, по транспорту.
+	DecryptionFailures *CounterVec
+}
+
+// NewServer создает реестр с метриками игрового сервера.
+func NewServer() *Server {
+	registry := NewRegistry()
+	return &Server{
+		Registry: registry,
+		Requests: registry.NewCounterVec("cu_http_requests_total",
+			"Total number of HTTP requests.", "route", "method", "status"),
+		RequestDuration: registry.NewHistogramVec("cu_http_request_duration_seconds",
+			"HTTP request latency in seconds.", DefaultBuckets, "route", "method"),
+		KeyExchangeFailures: registry.NewCounterVec("cu_key_exchange_failures_total",
+			"Total number of failed key exchanges.", "reason"),
+		DecryptionFailures: registry.NewCounterVec("cu_decryption_failures_total",
+			"Total number of messages that failed to decrypt.", "transport"),
+	}
+}
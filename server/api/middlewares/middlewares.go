@@ -1,20 +1,50 @@
 package middlewares
 
 import (
-	"log"
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
-)
+	"strconv"
+	"time"
 
-type TokenRequired struct {
-	Status  int    `json:"status"`
-	Message string `json:"message"`
-}
+	"cu/common/protocol"
+	"cu/server/api/database"
+	"cu/server/api/logging"
+	"cu/server/api/metrics"
+	"cu/server/api/ratelimit"
+	"cu/server/api/security"
+	"cu/server/api/wire"
+)
 
-// SetMiddlewareLogger displays a info message of the API
+// SetMiddlewareLogger присваивает запросу идентификатор и возвращает его в заголовке X-Request-ID.
+// Корректный идентификатор, переданный клиентом в том же заголовке, сохраняется.
+// В контекст запроса добавляется логгер с идентификатором, а по завершении
+// запроса в журнал записываются метод, путь, статус и длительность.
 func SetMiddlewareLogger(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s%s %s", r.Method, r.Host, r.RequestURI, r.Proto)
-		next(w, r)
+		requestID := r.Header.Get(logging.RequestIDHeader)
+		if !logging.ValidRequestID(requestID) {
+			requestID = logging.NewRequestID()
+		}
+		w.Header().Set(logging.RequestIDHeader, requestID)
+
+		logger := slog.Default().With(slog.String("request_id", requestID))
+		ctx := logging.WithLogger(r.Context(), logger)
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r.WithContext(ctx))
+
+		// Логгер берется из контекста заново: аутентификация могла дополнить его сведениями о сессии.
+		logging.FromContext(ctx).Info("Request completed",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_ip", ratelimit.ClientIP(r)),
+		)
 	}
 }
 
@@ -26,19 +56,133 @@ func SetMiddlewareJSON(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// func SetMiddlewareAuthentication(next http.HandlerFunc) http.HandlerFunc {
-// 	return func(w http.ResponseWriter, r *http.Request) {
-// 		token := auth.ExtractToken(w, r)
-// 		if token == nil {
-// 			return
-// 		}
-// 		if token.Valid {
-// 			ctx := context.WithValue(
-// 				r.Context(),
-// 				types.UserKey("user"),
-// 				token.Claims.(*models.Claim).User,
-// 			)
-// 			next(w, r.WithContext(ctx))
-// 		}
-// 	}
-// }
+// SetMiddlewareAuthentication проверяет SessionID и EAPI из заголовков X-Session-ID
+// и X-EAPI и добавляет в контекст security.Identity аутентифицированной сессии.
+// Статус 401 с кодом protocol.CodeUnauthorized означает, что сессия недействительна
+// и клиенту нужен новый обмен ключами, поэтому сбой хранилища отклоняется
+// статусом 500: он не должен стоить клиенту действующей сессии.
+func SetMiddlewareAuthentication(sessions *security.SessionStorage) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			sessionID := r.Header.Get("X-Session-ID")
+			logging.With(r.Context(), logging.SessionID(sessionID))
+
+			session, err := sessions.Authenticate(sessionID, r.Header.Get("X-EAPI"))
+			switch {
+			case err == nil:
+			case errors.Is(err, database.ErrKeyNotFound), errors.Is(err, security.ErrSessionExpired), errors.Is(err, security.ErrInvalidEAPI):
+				logging.FromContext(r.Context()).Warn("Authentication failed", logging.Error(err))
+				wire.Error(w, r, http.StatusUnauthorized, protocol.CodeUnauthorized, "Invalid SessionID or EAPI")
+				return
+			default:
+				logging.FromContext(r.Context()).Error("Unable to authenticate session", logging.Error(err))
+				wire.Error(w, r, http.StatusInternalServerError, protocol.CodeInternal, "Unable to authenticate session")
+				return
+			}
+
+			ctx := security.WithIdentity(r.Context(), &security.Identity{
+				SessionID: sessionID,
+				Session:   session,
+			})
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// SetMiddlewareClientIP определяет IP-адрес клиента с учетом доверенных прокси proxies
+// и сохраняет его в контексте запроса для ratelimit.ClientIP.
+// Должен применяться раньше остальных middleware, использующих адрес клиента.
+func SetMiddlewareClientIP(proxies ratelimit.TrustedProxies) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := ratelimit.WithClientIP(r.Context(), proxies.Resolve(r))
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// SetMiddlewareRateLimitByIP ограничивает частоту запросов с одного IP-адреса.
+// При превышении лимита отвечает статусом 429 с заголовком Retry-After.
+func SetMiddlewareRateLimitByIP(limiter *ratelimit.Limiter) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if ok, retryAfter := limiter.Allow(ratelimit.ClientIP(r)); !ok {
+				ratelimit.WriteTooManyRequests(w, r, retryAfter)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// SetMiddlewareRateLimitBySession ограничивает частоту запросов одной сессии.
+// Должен применяться после SetMiddlewareAuthentication.
+func SetMiddlewareRateLimitBySession(limiter *ratelimit.Limiter) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if identity, ok := security.IdentityFromContext(r.Context()); ok {
+				if ok, retryAfter := limiter.Allow(identity.SessionID); !ok {
+					ratelimit.WriteTooManyRequests(w, r, retryAfter)
+					return
+				}
+			}
+			next(w, r)
+		}
+	}
+}
+
+// SetMiddlewareMetrics учитывает запросы к маршруту route в метриках m.
+// Длительность WebSocket-соединений не измеряется: она отражает время жизни туннеля.
+func SetMiddlewareMetrics(m *metrics.Server, route string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next(recorder, r)
+
+			m.Requests.Inc(route, r.Method, strconv.Itoa(recorder.status))
+			if !recorder.hijacked {
+				m.RequestDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+			}
+		}
+	}
+}
+
+// statusRecorder запоминает статус ответа.
+// Поддерживает захват соединения, необходимый для WebSocket.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.ResponseWriter does not implement http.Hijacker")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		r.hijacked = true
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,88 @@
+package middlewares
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cu/common/cryptography"
+	"cu/common/protocol"
+	"cu/server/api/database"
+	"cu/server/api/security"
+)
+
+// failingStore завершает все транзакции ошибкой хранилища.
+type failingStore struct {
+	database.Store
+}
+
+var errStorage = errors.New("storage unavailable")
+
+func (failingStore) View(func(tx database.Tx) error) error {
+	return errStorage
+}
+
+func (failingStore) Update(func(tx database.Tx) error) error {
+	return errStorage
+}
+
+func TestSetMiddlewareAuthentication(t *testing.T) {
+	store, err := database.Open("badger", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	accessKey := []byte("0123456789abcdef0123456789abcdef")
+	session := &security.ServerSession{AccessKey: accessKey, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := security.NewSessionStorage(store).SaveSession(session, "session"); err != nil {
+		t.Fatal(err)
+	}
+	eapi := hex.EncodeToString(cryptography.ComputeEAPI(accessKey, time.Now().Unix()/30))
+
+	tests := []struct {
+		name       string
+		store      database.Store
+		header     http.Header
+		form       url.Values
+		wantStatus int
+		wantCode   string
+	}{
+		{"Valid", store, http.Header{"X-Session-Id": {"session"}, "X-Eapi": {eapi}}, nil, http.StatusOK, ""},
+		{"MissingSession", store, http.Header{"X-Session-Id": {"missing"}, "X-Eapi": {eapi}}, nil, http.StatusUnauthorized, protocol.CodeUnauthorized},
+		{"InvalidEAPI", store, http.Header{"X-Session-Id": {"session"}, "X-Eapi": {"00"}}, nil, http.StatusUnauthorized, protocol.CodeUnauthorized},
+		{"FormIgnored", store, nil, url.Values{"SessionID": {"session"}, "EAPI": {eapi}}, http.StatusUnauthorized, protocol.CodeUnauthorized},
+		{"StorageFailure", failingStore{store}, http.Header{"X-Session-Id": {"session"}, "X-Eapi": {eapi}}, nil, http.StatusInternalServerError, protocol.CodeInternal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := SetMiddlewareAuthentication(security.NewSessionStorage(test.store))(func(w http.ResponseWriter, r *http.Request) {
+				if identity, ok := security.IdentityFromContext(r.Context()); !ok || identity.SessionID != "session" {
+					t.Errorf("handler got identity %+v", identity)
+				}
+			})
+
+			request := httptest.NewRequest(http.MethodPost, "/action", strings.NewReader(test.form.Encode()))
+			if test.form != nil {
+				request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			for name, values := range test.header {
+				request.Header[name] = values
+			}
+			recorder := httptest.NewRecorder()
+			handler(recorder, request)
+
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status is %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if test.wantCode != "" && !strings.Contains(recorder.Body.String(), test.wantCode) {
+				t.Fatalf("response %q does not contain code %q", recorder.Body.String(), test.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cu/common/protocol"
+	"cu/server/api/wire"
+)
+
+// pruneInterval — период удаления неиспользуемых корзин.
+const pruneInterval = time.Minute
+
+// bucket — корзина токенов одного клиента.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter ограничивает частоту запросов алгоритмом token bucket.
+// Для каждого ключа хранится отдельная корзина емкостью burst,
+// которая пополняется со скоростью rate токенов в секунду.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+// NewLimiter создает ограничитель со скоростью rate запросов в секунду
+// и допустимым всплеском burst. Если rate не больше нуля, возвращается nil:
+// nil-ограничитель пропускает все запросы.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   math.Max(float64(burst), 1),
+		buckets: make(map[string]*bucket),
+		pruned:  time.Now(),
+	}
+}
+
+// Allow расходует токен ключа key. Если токенов нет, возвращается false
+// и время, через которое появится следующий токен.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return l.allowAt(key, time.Now())
+}
+
+// allowAt выполняет Allow для момента времени now.
+func (l *Limiter) allowAt(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune удаляет корзины, успевшие наполниться полностью: они неотличимы от новых.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < pruneInterval {
+		return
+	}
+	l.pruned = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// ClientIP возвращает IP-адрес клиента, определенный SetMiddlewareClientIP,
+// или, если его нет в контексте запроса, адрес соединения.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+// WithClientIP возвращает контекст с IP-адресом клиента ip.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+type clientIPKey struct{}
+
+// TrustedProxies — сети обратных прокси, адрес клиента от которых берется
+// из заголовка X-Forwarded-For. Остальные клиенты могут подделать заголовок,
+// поэтому для них используется адрес соединения.
+type TrustedProxies []netip.Prefix
+
+// Contains сообщает, входит ли адрес addr в сети доверенных прокси.
+func (p TrustedProxies) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve определяет IP-адрес клиента. Если соединение установлено доверенным прокси,
+// X-Forwarded-For просматривается справа налево до первого адреса не из доверенных сетей:
+// адреса левее него добавлены самим клиентом и могут быть подделаны.
+func (p TrustedProxies) Resolve(r *http.Request) string {
+	peer := peerIP(r)
+	client, err := netip.ParseAddr(peer)
+	if err != nil || !p.Contains(client) {
+		return peer
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = hop.Unmap()
+		if !p.Contains(client) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// peerIP возвращает IP-адрес из адреса соединения.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// WriteTooManyRequests отвечает статусом 429 с заголовком Retry-After в секундах
+// и конвертом ошибки protocol.CodeRateLimited.
+func WriteTooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	wire.Error(w, r, http.StatusTooManyRequests, protocol.CodeRateLimited, "Too Many Requests")
+}
@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	limiter := NewLimiter(2, 3)
+	now := time.Now()
+
+	for i := range 3 {
+		if ok, _ := limiter.allowAt("client", now); !ok {
+			t.Fatalf("request %d within the burst was rejected", i+1)
+		}
+	}
+	ok, retryAfter := limiter.allowAt("client", now)
+	if ok {
+		t.Fatal("request over the burst was allowed")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Fatalf("retry after %s, want 500ms", retryAfter)
+	}
+	if ok, _ := limiter.allowAt("other", now); !ok {
+		t.Fatal("another key shares the bucket")
+	}
+
+	// За полсекунды при скорости 2 токена в секунду появляется один токен.
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := limiter.allowAt("client", now); !ok {
+		t.Fatal("refilled token was not granted")
+	}
+	if ok, _ := limiter.allowAt("client", now); ok {
+		t.Fatal("more tokens were granted than refilled")
+	}
+
+	// Корзина не наполняется сверх burst, сколько бы времени ни прошло.
+	now = now.Add(time.Hour)
+	for i := range 3 {
+		if ok, _ := limiter.allowAt("client", now); !ok {
+			t.Fatalf("request %d after a long pause was rejected", i+1)
+		}
+	}
+	if ok, _ := limiter.allowAt("client", now); ok {
+		t.Fatal("bucket was filled over the burst")
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	limiter := NewLimiter(1, 2)
+	now := time.Now()
+	limiter.allowAt("idle", now)
+	limiter.allowAt("busy", now)
+	limiter.allowAt("busy", now)
+
+	// За pruneInterval при скорости 1 токен в секунду обе корзины наполняются
+	// и удаляются при следующем запросе.
+	now = now.Add(pruneInterval)
+	limiter.allowAt("fresh", now)
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("buckets after prune: %v, want only fresh", limiter.buckets)
+	}
+
+	// Корзина, которая еще не наполнилась, сохраняется вместе с расходом.
+	slow := NewLimiter(0.001, 2)
+	slow.allowAt("client", now)
+	slow.allowAt("client", now)
+	slow.allowAt("other", now.Add(pruneInterval))
+	if ok, _ := slow.allowAt("client", now.Add(pruneInterval)); ok {
+		t.Fatal("pruning reset a bucket that was not full")
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	limiter := NewLimiter(0, 10)
+	if limiter != nil {
+		t.Fatal("NewLimiter with zero rate returned a limiter")
+	}
+	if ok, _ := limiter.Allow("client"); !ok {
+		t.Fatal("nil limiter rejected a request")
+	}
+}
+
+func TestTrustedProxiesResolve(t *testing.T) {
+	proxies := TrustedProxies{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"NoHeader", "203.0.113.7:4000", nil, "203.0.113.7"},
+		{"SpoofedFromUntrustedPeer", "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"TrustedPeer", "10.0.0.1:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"TrustedPeerWithoutHeader", "10.0.0.1:4000", nil, "10.0.0.1"},
+		{"ProxyChain", "10.0.0.1:4000", []string{"198.51.100.1, 10.0.0.3, 10.0.0.2"}, "198.51.100.1"},
+		{"SpoofedPrefixBeforeProxies", "10.0.0.1:4000", []string{"192.0.2.66, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"SeveralHeaders", "10.0.0.1:4000", []string{"192.0.2.66", "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"AllHopsTrusted", "10.0.0.1:4000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"MalformedBeforeClient", "10.0.0.1:4000", []string{"garbage, 198.51.100.1"}, "198.51.100.1"},
+		{"MalformedAfterClient", "10.0.0.1:4000", []string{"198.51.100.1, garbage"}, "10.0.0.1"},
+		{"MalformedBetweenProxies", "10.0.0.1:4000", []string{"198.51.100.1, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"Empty", "10.0.0.1:4000", []string{""}, "10.0.0.1"},
+		{"IPv4MappedHop", "[::1]:4000", []string{"::ffff:198.51.100.1"}, "198.51.100.1"},
+		{"IPv4MappedPeer", "[::ffff:10.0.0.1]:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"MalformedRemoteAddr", "pipe", []string{"198.51.100.1"}, "pipe"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := proxies.Resolve(r); got != test.want {
+				t.Fatalf("Resolve returned %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:4000"
+	if got := ClientIP(r); got != "203.0.113.7" {
+		t.Fatalf("ClientIP without middleware returned %s", got)
+	}
+	r = r.WithContext(WithClientIP(r.Context(), "198.51.100.1"))
+	if got := ClientIP(r); got != "198.51.100.1" {
+		t.Fatalf("ClientIP returned %s, want the resolved address", got)
+	}
+}
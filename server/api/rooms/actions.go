@@ -0,0 +1,113 @@
+package rooms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"cu/common/protocol"
+	"cu/server/api/actions"
+)
+
+// RoomInfo описывает комнату в ответах клиенту.
+// Вместо идентификаторов сессий участники представлены их хешами.
+type RoomInfo struct {
+	ID       string   `json:"ID"`
+	Capacity int      `json:"Capacity"`
+	Members  []string `json:"Members"`
+}
+
+// roomRequest содержит идентификатор комнаты из нагрузки действия.
+type roomRequest struct {
+	RoomID string `json:"RoomID"`
+}
+
+// RegisterActions регистрирует действия для работы с комнатами.
+func RegisterActions(registry *actions.Registry, storage *RoomStorage) {
+	registry.Handle("room.create", func(_ context.Context, req *actions.Request) (any, error) {
+		var payload roomRequest
+		if len(req.Payload) > 0 {
+			if err := req.Decode(&payload); err != nil {
+				return nil, err
+			}
+		}
+
+		room, err := storage.Create(payload.RoomID)
+		if err != nil {
+			return nil, roomError(err)
+		}
+		if room, err = storage.Bind(req.SessionID, req.Session, room.ID, false); err != nil {
+			return nil, roomError(err)
+		}
+		return newRoomInfo(room), nil
+	})
+
+	registry.Handle("room.join", func(_ context.Context, req *actions.Request) (any, error) {
+		var payload roomRequest
+		if err := req.Decode(&payload); err != nil {
+			return nil, err
+		}
+
+		room, err := storage.Bind(req.SessionID, req.Session, payload.RoomID, false)
+		if err != nil {
+			return nil, roomError(err)
+		}
+		return newRoomInfo(room), nil
+	})
+
+	registry.Handle("room.leave", func(_ context.Context, req *actions.Request) (any, error) {
+		if req.Session.RoomID == "" {
+			return nil, protocol.NewError(protocol.CodeNotInRoom, "Session is not bound to a room")
+		}
+		if err := storage.Unbind(req.SessionID, req.Session); err != nil {
+			return nil, roomError(err)
+		}
+		return nil, nil
+	})
+
+	registry.Handle("room.members", func(_ context.Context, req *actions.Request) (any, error) {
+		if req.Session.RoomID == "" {
+			return nil, protocol.NewError(protocol.CodeNotInRoom, "Session is not bound to a room")
+		}
+		room, err := storage.Get(req.Session.RoomID)
+		if err != nil {
+			return nil, roomError(err)
+		}
+		if room.Members, err = storage.Members(room.ID); err != nil {
+			return nil, roomError(err)
+		}
+		return newRoomInfo(room), nil
+	})
+}
+
+// newRoomInfo формирует описание комнаты для клиента.
+func newRoomInfo(room *Room) *RoomInfo {
+	members := make([]string, 0, len(room.Members))
+	for _, sessionID := range room.Members {
+		members = append(members, MemberID(sessionID))
+	}
+	return &RoomInfo{ID: room.ID, Capacity: room.Capacity, Members: members}
+}
+
+// MemberID возвращает публичный идентификатор участника по идентификатору его сессии.
+func MemberID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// roomError преобразует ошибку хранилища комнат в ошибку протокола.
+// Клиенту передается только текст известной ошибки, без подробностей обертки.
+func roomError(err error) error {
+	switch {
+	case errors.Is(err, ErrRoomNotFound):
+		return protocol.NewError(protocol.CodeRoomNotFound, ErrRoomNotFound.Error())
+	case errors.Is(err, ErrRoomExists):
+		return protocol.NewError(protocol.CodeRoomExists, ErrRoomExists.Error())
+	case errors.Is(err, ErrRoomFull):
+		return protocol.NewError(protocol.CodeRoomFull, ErrRoomFull.Error())
+	case errors.Is(err, ErrInvalidRoomID):
+		return protocol.NewError(protocol.CodeBadRequest, ErrInvalidRoomID.Error())
+	}
+	return err
+}
@@ -0,0 +1,310 @@
+package rooms
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"cu/server/api/database"
+	"cu/server/api/security"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrRoomNotFound возвращается, если комната не существует или истекла.
+	ErrRoomNotFound = errors.New("room not found")
+	// ErrRoomExists возвращается при создании комнаты с занятым идентификатором.
+	ErrRoomExists = errors.New("room already exists")
+	// ErrRoomFull возвращается, если в комнате не осталось свободных мест.
+	ErrRoomFull = errors.New("room is full")
+	// ErrInvalidRoomID возвращается для пустого или слишком длинного идентификатора.
+	ErrInvalidRoomID = errors.New("invalid room id")
+)
+
+// maxRoomIDLength ограничивает длину идентификатора комнаты.
+const maxRoomIDLength = 64
+
+// maxTouchInterval ограничивает период, с которым Touch переписывает комнату.
+const maxTouchInterval = time.Minute
+
+// Room представляет игровую комнату и ее участников.
+type Room struct {
+	ID         string
+	Capacity   int
+	Members    []string
+	CreatedAt  time.Time
+	LastActive time.Time
+}
+
+// RoomStorage предоставляет методы для хранения комнат.
+// Комната удаляется автоматически, если в ней нет активности дольше idleTimeout.
+type RoomStorage struct {
+	store       database.Store
+	sessions    *security.SessionStorage
+	capacity    int
+	idleTimeout time.Duration
+}
+
+// NewRoomStorage создает новый экземпляр RoomStorage.
+func NewRoomStorage(store database.Store, capacity int, idleTimeout time.Duration) *RoomStorage {
+	return &RoomStorage{
+		store:       store,
+		sessions:    security.NewSessionStorage(store),
+		capacity:    capacity,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// roomKey возвращает ключ комнаты в базе данных.
+func roomKey(roomID string) []byte {
+	return []byte("room:" + roomID)
+}
+
+// Create создает пустую комнату. Если roomID пуст, идентификатор генерируется.
+func (s *RoomStorage) Create(roomID string) (*Room, error) {
+	if roomID == "" {
+		roomID = uuid.New().String()
+	}
+	if len(roomID) > maxRoomIDLength {
+		return nil, ErrInvalidRoomID
+	}
+
+	now := time.Now()
+	room := &Room{
+		ID:         roomID,
+		Capacity:   s.capacity,
+		CreatedAt:  now,
+		LastActive: now,
+	}
+	err := s.store.Update(func(tx database.Tx) error {
+		if _, err := tx.Get(roomKey(roomID)); err == nil {
+			return ErrRoomExists
+		} else if !errors.Is(err, database.ErrKeyNotFound) {
+			return err
+		}
+		return s.put(tx, room)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// Get извлекает комнату по идентификатору roomID.
+func (s *RoomStorage) Get(roomID string) (*Room, error) {
+	var room *Room
+	err := s.store.View(func(tx database.Tx) error {
+		var err error
+		room, err = s.get(tx, roomID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// Join добавляет сессию sessionID в комнату roomID.
+// Если create равен true, отсутствующая комната создается.
+func (s *RoomStorage) Join(roomID, sessionID string, create bool) (*Room, error) {
+	if roomID == "" || len(roomID) > maxRoomIDLength {
+		return nil, ErrInvalidRoomID
+	}
+
+	// Истекшие сессии ищутся до транзакции: проверка обращается к хранилищу сессий,
+	// а вложенные транзакции поддерживаются не всеми хранилищами.
+	var stale []string
+	if existing, err := s.Get(roomID); err == nil {
+		stale = s.staleMembers(existing.Members)
+	}
+
+	var room *Room
+	err := s.store.Update(func(tx database.Tx) error {
+		var err error
+		room, err = s.get(tx, roomID)
+		if errors.Is(err, ErrRoomNotFound) && create {
+			room = &Room{ID: roomID, Capacity: s.capacity, CreatedAt: time.Now()}
+		} else if err != nil {
+			return err
+		}
+
+		if !slices.Contains(room.Members, sessionID) {
+			room.Members = slices.DeleteFunc(room.Members, func(member string) bool {
+				return slices.Contains(stale, member)
+			})
+			if len(room.Members) >= room.Capacity {
+				return ErrRoomFull
+			}
+			room.Members = append(room.Members, sessionID)
+		}
+
+		room.LastActive = time.Now()
+		return s.put(tx, room)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// Leave удаляет сессию sessionID из комнаты roomID.
+// Комната без участников удаляется.
+func (s *RoomStorage) Leave(roomID, sessionID string) error {
+	return s.store.Update(func(tx database.Tx) error {
+		room, err := s.get(tx, roomID)
+		if err != nil {
+			return err
+		}
+
+		room.Members = slices.DeleteFunc(room.Members, func(member string) bool {
+			return member == sessionID
+		})
+		if len(room.Members) == 0 {
+			return tx.Delete(roomKey(roomID))
+		}
+
+		room.LastActive = time.Now()
+		return s.put(tx, room)
+	})
+}
+
+// Touch отмечает активность в комнате roomID и продлевает срок ее жизни.
+// Чтобы действия участников не переписывали общую запись на каждом запросе,
+// комната обновляется, только если с прошлой активности прошло больше
+// четверти idleTimeout, но не больше maxTouchInterval.
+func (s *RoomStorage) Touch(roomID string) error {
+	room, err := s.Get(roomID)
+	if err != nil {
+		return err
+	}
+	if time.Since(room.LastActive) < s.touchInterval() {
+		return nil
+	}
+
+	return s.store.Update(func(tx database.Tx) error {
+		room, err := s.get(tx, roomID)
+		if err != nil {
+			return err
+		}
+		room.LastActive = time.Now()
+		return s.put(tx, room)
+	})
+}
+
+// touchInterval возвращает минимальный период между обновлениями комнаты в Touch.
+func (s *RoomStorage) touchInterval() time.Duration {
+	return min(s.idleTimeout/4, maxTouchInterval)
+}
+
+// Members возвращает идентификаторы сессий, находящихся в комнате roomID.
+func (s *RoomStorage) Members(roomID string) ([]string, error) {
+	room, err := s.Get(roomID)
+	if err != nil {
+		return nil, err
+	}
+	stale := s.staleMembers(room.Members)
+	return slices.DeleteFunc(room.Members, func(member string) bool {
+		return slices.Contains(stale, member)
+	}), nil
+}
+
+// Bind переносит сессию в комнату roomID, покидая предыдущую комнату сессии,
+// и сохраняет привязку в сессии. В хранилище меняется только RoomID: остальные
+// поля session могли устареть, например порядковый номер или ключ доступа.
+func (s *RoomStorage) Bind(sessionID string, session *security.ServerSession, roomID string, create bool) (*Room, error) {
+	room, err := s.Join(roomID, sessionID, create)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := s.setSessionRoom(sessionID, roomID)
+	if err != nil {
+		// Сессия не попала в комнату: место, занятое Join, освобождается.
+		if session.RoomID != roomID {
+			s.Leave(roomID, sessionID)
+		}
+		return nil, err
+	}
+	session.RoomID = roomID
+
+	if previous != "" && previous != roomID {
+		if err := s.Leave(previous, sessionID); err != nil && !errors.Is(err, ErrRoomNotFound) {
+			return nil, err
+		}
+	}
+	return room, nil
+}
+
+// Unbind выводит сессию из ее текущей комнаты и снимает привязку в сессии.
+func (s *RoomStorage) Unbind(sessionID string, session *security.ServerSession) error {
+	previous, err := s.setSessionRoom(sessionID, "")
+	if err != nil {
+		return err
+	}
+	session.RoomID = ""
+
+	if previous == "" {
+		return nil
+	}
+	if err := s.Leave(previous, sessionID); err != nil && !errors.Is(err, ErrRoomNotFound) {
+		return err
+	}
+	return nil
+}
+
+// setSessionRoom атомарно привязывает сохраненную сессию sessionID к комнате roomID
+// и возвращает прежнюю комнату сессии.
+func (s *RoomStorage) setSessionRoom(sessionID, roomID string) (string, error) {
+	var previous string
+	_, err := s.sessions.UpdateSession(sessionID, func(session *security.ServerSession) error {
+		previous = session.RoomID
+		session.RoomID = roomID
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to update session room: %w", err)
+	}
+	return previous, nil
+}
+
+// staleMembers возвращает участников, чьи сессии уже истекли.
+func (s *RoomStorage) staleMembers(members []string) []string {
+	var stale []string
+	for _, member := range members {
+		session, err := s.sessions.GetSession(member)
+		if err != nil || time.Now().After(session.ExpiresAt) {
+			stale = append(stale, member)
+		}
+	}
+	return stale
+}
+
+// get читает комнату в рамках транзакции tx.
+func (s *RoomStorage) get(tx database.Tx, roomID string) (*Room, error) {
+	value, err := tx.Get(roomKey(roomID))
+	if errors.Is(err, database.ErrKeyNotFound) {
+		return nil, ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var room Room
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&room); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+// put сохраняет комнату в рамках транзакции tx и продлевает срок ее жизни.
+func (s *RoomStorage) put(tx database.Tx, room *Room) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(room); err != nil {
+		return err
+	}
+	return tx.Set(roomKey(room.ID), buf.Bytes(), s.idleTimeout)
+}
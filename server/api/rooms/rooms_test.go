@@ -0,0 +1,213 @@
+package rooms
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"cu/server/api/database"
+	"cu/server/api/security"
+)
+
+// drivers перечисляет хранилища, на которых проверяются комнаты.
+var drivers = []struct {
+	name string
+	open func(t *testing.T) database.Store
+}{
+	{"badger", func(t *testing.T) database.Store {
+		store, err := database.Open("badger", t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+	{"sqlite", func(t *testing.T) database.Store {
+		store, err := database.Open("sqlite", filepath.Join(t.TempDir(), "store.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+}
+
+// testIdleTimeout — срок жизни комнаты без активности в тестах.
+// Badger хранит срок жизни с точностью до секунды, поэтому он не меньше двух секунд.
+const testIdleTimeout = 2 * time.Second
+
+// roomTests описывают поведение RoomStorage, общее для всех хранилищ.
+var roomTests = []struct {
+	name string
+	run  func(t *testing.T, store database.Store, rooms *RoomStorage)
+}{
+	{"Capacity", func(t *testing.T, store database.Store, rooms *RoomStorage) {
+		sessions := newSessions(t, store, "a", "b", "c")
+		mustJoin(t, rooms, "room", sessions[0], true)
+		mustJoin(t, rooms, "room", sessions[1], false)
+		if _, err := rooms.Join("room", sessions[2], false); !errors.Is(err, ErrRoomFull) {
+			t.Fatalf("Join of a full room returned %v, want ErrRoomFull", err)
+		}
+		// Повторный вход участника не занимает нового места.
+		room := mustJoin(t, rooms, "room", sessions[0], false)
+		if len(room.Members) != 2 {
+			t.Fatalf("room has members %v, want 2", room.Members)
+		}
+	}},
+	{"JoinMissing", func(t *testing.T, store database.Store, rooms *RoomStorage) {
+		sessions := newSessions(t, store, "a")
+		if _, err := rooms.Join("missing", sessions[0], false); !errors.Is(err, ErrRoomNotFound) {
+			t.Fatalf("Join of a missing room returned %v, want ErrRoomNotFound", err)
+		}
+		if _, err := rooms.Join("", sessions[0], true); !errors.Is(err, ErrInvalidRoomID) {
+			t.Fatalf("Join with an empty room id returned %v, want ErrInvalidRoomID", err)
+		}
+	}},
+	{"StaleMembers", func(t *testing.T, store database.Store, rooms *RoomStorage) {
+		sessions := newSessions(t, store, "a", "b", "c")
+		mustJoin(t, rooms, "room", sessions[0], true)
+		mustJoin(t, rooms, "room", sessions[1], false)
+		if err := security.NewSessionStorage(store).DeleteSession(sessions[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		members, err := rooms.Members("room")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(members, sessions[:1]) {
+			t.Fatalf("Members returned %v, want %v", members, sessions[:1])
+		}
+		// Место участника с удаленной сессией освобождается при входе.
+		room := mustJoin(t, rooms, "room", sessions[2], false)
+		if want := []string{sessions[0], sessions[2]}; !slices.Equal(room.Members, want) {
+			t.Fatalf("room has members %v, want %v", room.Members, want)
+		}
+	}},
+	{"LeaveDeletesEmptyRoom", func(t *testing.T, store database.Store, rooms *RoomStorage) {
+		sessions := newSessions(t, store, "a", "b")
+		mustJoin(t, rooms, "room", sessions[0], true)
+		mustJoin(t, rooms, "room", sessions[1], false)
+
+		if err := rooms.Leave("room", sessions[0]); err != nil {
+			t.Fatal(err)
+		}
+		if room, err := rooms.Get("room"); err != nil || !slices.Equal(room.Members, sessions[1:]) {
+			t.Fatalf("Get after Leave returned %v, %v", room, err)
+		}
+		if err := rooms.Leave("room", sessions[1]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rooms.Get("room"); !errors.Is(err, ErrRoomNotFound) {
+			t.Fatalf("empty room was not deleted: %v", err)
+		}
+	}},
+	{"Bind", func(t *testing.T, store database.Store, rooms *RoomStorage) {
+		sessionStorage := security.NewSessionStorage(store)
+		id := newSessions(t, store, "a")[0]
+		session, err := sessionStorage.GetSession(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := rooms.Bind(id, session, "first", true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rooms.Bind(id, session, "second", true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rooms.Get("first"); !errors.Is(err, ErrRoomNotFound) {
+			t.Fatalf("previous room was not left: %v", err)
+		}
+		if stored, err := sessionStorage.GetSession(id); err != nil || stored.RoomID != "second" || session.RoomID != "second" {
+			t.Fatalf("session room is %q (stored %v, %v), want second", session.RoomID, stored, err)
+		}
+
+		if err := rooms.Unbind(id, session); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rooms.Get("second"); !errors.Is(err, ErrRoomNotFound) {
+			t.Fatalf("room was not left on Unbind: %v", err)
+		}
+		if stored, err := sessionStorage.GetSession(id); err != nil || stored.RoomID != "" {
+			t.Fatalf("session is still bound: %v, %v", stored, err)
+		}
+	}},
+	{"IdleExpiry", func(t *testing.T, store database.Store, rooms *RoomStorage) {
+		sessions := newSessions(t, store, "a")
+		mustJoin(t, rooms, "room", sessions[0], true)
+		time.Sleep(testIdleTimeout + time.Second)
+		if _, err := rooms.Get("room"); !errors.Is(err, ErrRoomNotFound) {
+			t.Fatalf("idle room was not deleted: %v", err)
+		}
+	}},
+	{"TouchKeepsRoomAlive", func(t *testing.T, store database.Store, rooms *RoomStorage) {
+		sessions := newSessions(t, store, "a")
+		joined := mustJoin(t, rooms, "room", sessions[0], true)
+
+		// Участник отправляет действия дольше, чем живет комната без активности.
+		for deadline := time.Now().Add(testIdleTimeout + time.Second); time.Now().Before(deadline); {
+			if err := rooms.Touch("room"); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		room, err := rooms.Get("room")
+		if err != nil {
+			t.Fatalf("active room was deleted: %v", err)
+		}
+		if !room.LastActive.After(joined.LastActive) {
+			t.Fatalf("LastActive %s was not advanced from %s", room.LastActive, joined.LastActive)
+		}
+		if !slices.Equal(room.Members, sessions) {
+			t.Fatalf("room has members %v, want %v", room.Members, sessions)
+		}
+	}},
+	{"TouchMissing", func(t *testing.T, _ database.Store, rooms *RoomStorage) {
+		if err := rooms.Touch("missing"); !errors.Is(err, ErrRoomNotFound) {
+			t.Fatalf("Touch of a missing room returned %v, want ErrRoomNotFound", err)
+		}
+	}},
+}
+
+func TestRoomStorage(t *testing.T) {
+	for _, driver := range drivers {
+		t.Run(driver.name, func(t *testing.T) {
+			for _, test := range roomTests {
+				t.Run(test.name, func(t *testing.T) {
+					t.Parallel()
+					store := driver.open(t)
+					t.Cleanup(func() {
+						if err := store.Close(); err != nil {
+							t.Error(err)
+						}
+					})
+					test.run(t, store, NewRoomStorage(store, 2, testIdleTimeout))
+				})
+			}
+		})
+	}
+}
+
+// newSessions сохраняет действующие сессии с идентификаторами ids и возвращает ids.
+func newSessions(t *testing.T, store database.Store, ids ...string) []string {
+	t.Helper()
+	sessions := security.NewSessionStorage(store)
+	for _, id := range ids {
+		session := &security.ServerSession{AccessKey: []byte("access key"), ExpiresAt: time.Now().Add(time.Hour)}
+		if err := sessions.SaveSession(session, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+func mustJoin(t *testing.T, rooms *RoomStorage, roomID, sessionID string, create bool) *Room {
+	t.Helper()
+	room, err := rooms.Join(roomID, sessionID, create)
+	if err != nil {
+		t.Fatalf("Join(%q, %q): %v", roomID, sessionID, err)
+	}
+	return room
+}
@@ -1,46 +1,152 @@
 package router
 
 import (
+	"context"
+	"cu/server/api/actions"
 	"cu/server/api/controllers"
+	"cu/server/api/database"
+	"cu/server/api/metrics"
+	"cu/server/api/middlewares"
+	"cu/server/api/ratelimit"
+	"cu/server/api/rooms"
+	"cu/server/api/security"
+	"cu/server/config"
 	"net/http"
+	"time"
 
-	"github.com/dgraph-io/badger/v4"
 	"github.com/gorilla/mux"
 )
 
+// Route описывает маршрут API.
+// Маршруты с AuthRequired доступны только с действующими SessionID и EAPI
+// и ограничены по частоте для каждой сессии. Маршруты с RateLimited
+// ограничены по частоте для каждого IP-адреса. Запросы к маршрутам с Quiet
+// не записываются в журнал: их часто опрашивает балансировщик нагрузки.
+type Route struct {
+	URI          string
+	Method       string
+	Handler      http.HandlerFunc
+	AuthRequired bool
+	RateLimited  bool
+	Quiet        bool
+}
+
 type Router struct {
-	muxRouter  *mux.Router
-	privateKey [32]byte
-	publicKey  [32]byte
-	db         *badger.DB
+	muxRouter *mux.Router
+	config    *config.Config
+	keys      *security.ServerKeysStorage
+	db        database.Store
+	tunnels   *controllers.Hub
 }
 
-func NewRouter(privateKey, publicKey [32]byte, db *badger.DB) *Router {
+func NewRouter(cfg *config.Config, keys *security.ServerKeysStorage, db database.Store) *Router {
 	return &Router{
-		muxRouter:  mux.NewRouter().StrictSlash(true),
-		privateKey: privateKey,
-		publicKey:  publicKey,
-		db:         db,
+		muxRouter: mux.NewRouter().StrictSlash(true),
+		config:    cfg,
+		keys:      keys,
+		db:        db,
 	}
 }
 
 func (router *Router) SetupRoutes() *mux.Router {
 	// Инициализация контроллеров с передачей ключей и базы данных
-	playController := controllers.NewPlayController(router.privateKey, router.publicKey, router.db)
+	roomStorage := rooms.NewRoomStorage(router.db, router.config.Rooms.Capacity, router.config.Rooms.IdleTimeout)
+	var telegram *security.TelegramValidator
+	if router.config.Telegram.BotToken != "" {
+		telegram = security.NewTelegramValidator(router.config.Telegram.BotToken, router.config.Telegram.AuthMaxAge)
+	}
+	limits := router.config.RateLimit
+	ipLimiter := ratelimit.NewLimiter(limits.IPRate, limits.IPBurst)
+	sessionLimiter := ratelimit.NewLimiter(limits.SessionRate, limits.SessionBurst)
+
+	serverMetrics := metrics.NewServer()
+	sessions := security.NewSessionStorage(router.db)
+	registerStorageMetrics(serverMetrics.Registry, router.db, sessions)
+
+	playController := controllers.NewPlayController(router.keys, router.db, roomStorage, telegram, serverMetrics, limits.MaxSessionsPerClient)
+	router.tunnels = playController.Tunnels()
+	healthController := controllers.NewHealthController(router.keys, router.db)
+	// Обновление ключа доступа доступно только через /action: туннель шифруется
+	// ключом, полученным при его открытии, и после обновления закрывается.
+	tunnelRegistry := newActionRegistry(roomStorage)
+	registry := newActionRegistry(roomStorage)
+	registry.Handle("session.refresh", playController.RefreshSession)
 
 	router.muxRouter.PathPrefix("/static/").Handler(
 		http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))),
 	)
 
-	// Настройка маршрутов
-	router.muxRouter.HandleFunc("/{room_id}", playController.PageRequest).Methods("GET")
-	router.muxRouter.HandleFunc("/key-exchange", playController.KeyExchangeRequest).Methods("POST")
-	router.muxRouter.HandleFunc("/action", playController.ActionRequest(func(message string) string {
-		if message == "ping" {
-			return "pong"
+	// Настройка маршрутов. Порядок важен: "/{room_id}" перехватывает
+	// все GET-запросы из одного сегмента, поэтому такие маршруты объявляются раньше.
+	routes := []Route{
+		{URI: "/healthz", Method: "GET", Handler: healthController.Healthz, Quiet: true},
+		{URI: "/readyz", Method: "GET", Handler: healthController.Readyz, Quiet: true},
+		{URI: "/version", Method: "GET", Handler: healthController.Version},
+		{URI: "/metrics", Method: "GET", Handler: serverMetrics.Registry.Handler, Quiet: true},
+		{URI: "/tunnel", Method: "GET", Handler: playController.TunnelRequest(tunnelRegistry, sessionLimiter), RateLimited: true},
+		{URI: "/{room_id}", Method: "GET", Handler: playController.PageRequest},
+		{URI: "/key-exchange", Method: "POST", Handler: playController.KeyExchangeRequest, RateLimited: true},
+		{URI: "/action", Method: "POST", Handler: playController.ActionRequest(registry), AuthRequired: true, RateLimited: true},
+		{URI: "/logout", Method: "POST", Handler: playController.LogoutRequest, AuthRequired: true, RateLimited: true},
+	}
+
+	authenticate := middlewares.SetMiddlewareAuthentication(sessions)
+	limitSession := middlewares.SetMiddlewareRateLimitBySession(sessionLimiter)
+	limitIP := middlewares.SetMiddlewareRateLimitByIP(ipLimiter)
+	resolveClientIP := middlewares.SetMiddlewareClientIP(ratelimit.TrustedProxies(router.config.TrustedProxies))
+	for _, route := range routes {
+		handler := route.Handler
+		if route.AuthRequired {
+			handler = authenticate(limitSession(handler))
+		}
+		if route.RateLimited {
+			handler = limitIP(handler)
+		}
+		handler = middlewares.SetMiddlewareMetrics(serverMetrics, route.URI)(handler)
+		if !route.Quiet {
+			handler = middlewares.SetMiddlewareLogger(handler)
 		}
-		return message
-	})).Methods("POST")
+		handler = resolveClientIP(handler)
+		router.muxRouter.HandleFunc(route.URI, handler).Methods(route.Method)
+	}
 
 	return router.muxRouter
 }
+
+// Tunnels возвращает реестр открытых WebSocket-туннелей.
+// Доступен после вызова SetupRoutes.
+func (router *Router) Tunnels() *controllers.Hub {
+	return router.tunnels
+}
+
+// registerStorageMetrics регистрирует показатели числа действующих сессий и размера базы данных.
+// Размер публикуется, только если хранилище умеет его сообщить.
+func registerStorageMetrics(registry *metrics.Registry, db database.Store, sessions *security.SessionStorage) {
+	registry.NewGaugeFunc("cu_active_sessions", "Number of active sessions.", func() (float64, error) {
+		var count int
+		err := sessions.ListSessions(func(_ string, session *security.ServerSession) error {
+			if time.Now().Before(session.ExpiresAt) {
+				count++
+			}
+			return nil
+		})
+		return float64(count), err
+	})
+
+	if sizer, ok := db.(database.Sizer); ok {
+		registry.NewGaugeFunc("cu_database_size_bytes", "Size of the database in bytes.", func() (float64, error) {
+			size, err := sizer.Size()
+			return float64(size), err
+		})
+	}
+}
+
+// newActionRegistry создает реестр действий, доступных клиентам через туннель.
+func newActionRegistry(roomStorage *rooms.RoomStorage) *actions.Registry {
+	registry := actions.NewRegistry()
+	registry.Handle("ping", func(_ context.Context, _ *actions.Request) (any, error) {
+		return "pong", nil
+	})
+	rooms.RegisterActions(registry, roomStorage)
+	return registry
+}
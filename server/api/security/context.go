@@ -0,0 +1,29 @@
+package security
+
+import "context"
+
+// identityContextKey — ключ, под которым Identity хранится в context.Context.
+type identityContextKey struct{}
+
+// Identity описывает аутентифицированного клиента запроса.
+type Identity struct {
+	SessionID string
+	Session   *ServerSession
+}
+
+// TelegramUserID возвращает идентификатор пользователя Telegram, привязанного к сессии.
+// Для анонимной сессии возвращается 0.
+func (i *Identity) TelegramUserID() int64 {
+	return i.Session.TelegramUserID
+}
+
+// WithIdentity возвращает копию ctx, содержащую identity.
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// IdentityFromContext извлекает Identity, добавленную middleware аутентификации.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(*Identity)
+	return identity, ok
+}
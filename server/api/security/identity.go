@@ -0,0 +1,89 @@
+package security
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"cu/common/cryptography"
+	"cu/server/api/database"
+)
+
+// identityKey — ключ записи долговременного ключа подписи сервера.
+const identityKey = "serverKeys:identity"
+
+// Identity возвращает долговременный ключ подписи сервера Ed25519, которым подписывается
+// стенограмма обмена ключами. Ключ создается при первом обращении и, в отличие от
+// ключей X25519, не ротируется: его публичная часть встраивается в клиент при сборке.
+// Приватная часть хранится зашифрованной так же, как приватные ключи X25519.
+func (s *ServerKeysStorage) Identity() (ed25519.PrivateKey, error) {
+	s.identityMu.Lock()
+	defer s.identityMu.Unlock()
+	if s.identity != nil {
+		return s.identity, nil
+	}
+
+	var identity ed25519.PrivateKey
+	err := s.store.Update(func(tx database.Tx) error {
+		value, err := tx.Get([]byte(identityKey))
+		if err == nil {
+			identity, err = s.unwrapIdentity(value)
+			return err
+		}
+		if !errors.Is(err, database.ErrKeyNotFound) {
+			return err
+		}
+
+		_, identity, err = cryptography.GenerateIdentityKey()
+		if err != nil {
+			return fmt.Errorf("failed to generate identity key: %w", err)
+		}
+		value, err = s.wrapIdentity(identity)
+		if err != nil {
+			return err
+		}
+		return tx.Set([]byte(identityKey), value, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.identity = identity
+	return identity, nil
+}
+
+// wrapIdentity сериализует ключ подписи, шифруя его приватную часть.
+func (s *ServerKeysStorage) wrapIdentity(identity ed25519.PrivateKey) ([]byte, error) {
+	wrapped, err := cryptography.EncryptAES(identity.Seed(), s.kek, []byte(identityKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt identity key: %w", err)
+	}
+	return json.Marshal(storedKeys{
+		PublicKey:  hex.EncodeToString(identity.Public().(ed25519.PublicKey)),
+		PrivateKey: wrapped,
+	})
+}
+
+// unwrapIdentity восстанавливает ключ подписи из записи хранилища.
+func (s *ServerKeysStorage) unwrapIdentity(value []byte) (ed25519.PrivateKey, error) {
+	var stored storedKeys
+	if err := json.Unmarshal(value, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode identity key: %w", err)
+	}
+
+	seed, err := cryptography.DecryptAES(stored.PrivateKey, s.kek, []byte(identityKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt identity key (was the secret changed?): %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid identity key length: %d", len(seed))
+	}
+
+	identity := ed25519.NewKeyFromSeed([]byte(seed))
+	if hex.EncodeToString(identity.Public().(ed25519.PublicKey)) != stored.PublicKey {
+		return nil, errors.New("identity key does not match its public key")
+	}
+	return identity, nil
+}
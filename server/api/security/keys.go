@@ -1,81 +1,355 @@
 package security
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
-	"github.com/dgraph-io/badger/v4"
+	"cu/common/cryptography"
+	"cu/server/api/database"
 )
 
+// LegacyKeyID — идентификатор ключа, который использовался до появления ротации.
+const LegacyKeyID = "production"
+
+const (
+	activeKeyIDKey = "serverKeys:active"
+	rotatedAtKey   = "serverKeys:rotatedAt"
+)
+
+// ErrNoActiveKey возвращается, если активный ключ сервера еще не создан.
+var ErrNoActiveKey = errors.New("no active server key")
+
 // ServerKeys представляет приватный и публичный ключи сервера.
 type ServerKeys struct {
+	ID         string
 	PrivateKey [32]byte
 	PublicKey  [32]byte
 }
 
+// Fingerprint возвращает отпечаток публичного ключа: SHA-256 в шестнадцатеричном виде.
+// По нему клиенты и администраторы сверяют ключ сервера, не передавая сам ключ.
+func (k *ServerKeys) Fingerprint() string {
+	sum := sha256.Sum256(k.PublicKey[:])
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateServerKeys генерирует новую пару ключей с уникальным идентификатором.
+func GenerateServerKeys() (*ServerKeys, error) {
+	privateKey, publicKey, err := cryptography.GenerateKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key pair: %w", err)
+	}
+
+	return &ServerKeys{
+		ID:         fmt.Sprintf("k%d", time.Now().UnixNano()),
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+	}, nil
+}
+
 // ServerKeysStorage предоставляет методы для хранения и извлечения ключей сервера.
+// Приватные ключи хранятся зашифрованными ключом шифрования ключей (KEK),
+// который выводится из секрета сервера.
 type ServerKeysStorage struct {
-	db *badger.DB
+	store database.Store
+	kek   []byte
+
+	// identity кэширует ключ подписи сервера: он не меняется после создания.
+	identityMu sync.Mutex
+	identity   ed25519.PrivateKey
 }
 
 // NewServerKeysStorage создает новый экземпляр ServerKeysStorage.
-func NewServerKeysStorage(db *badger.DB) *ServerKeysStorage {
-	return &ServerKeysStorage{db: db}
+// Ключ шифрования приватных ключей выводится из секрета secret.
+func NewServerKeysStorage(store database.Store, secret []byte) (*ServerKeysStorage, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("secret is required to encrypt server keys")
+	}
+	kek, err := cryptography.GenerateKeyEncryptionKey(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key encryption key: %w", err)
+	}
+	return &ServerKeysStorage{store: store, kek: kek}, nil
+}
+
+// storedKeys — запись ключей сервера в хранилище.
+// PrivateKey зашифрован KEK с идентификатором ключа в качестве дополнительных данных,
+// поэтому запись нельзя подменить записью другого ключа.
+type storedKeys struct {
+	PublicKey  string `json:"PublicKey"`
+	PrivateKey string `json:"PrivateKey"`
+}
+
+// keysKey возвращает ключ записи ключей сервера keyID в хранилище.
+func keysKey(keyID string) []byte {
+	return []byte("serverKeys:key:" + keyID)
+}
+
+// legacyPrivateKey и legacyPublicKey возвращают ключи записей, в которых
+// ключи сервера хранились открытым текстом до появления шифрования.
+func legacyPrivateKey(keyID string) []byte {
+	return []byte(keyID + ":privateKey")
+}
+
+func legacyPublicKey(keyID string) []byte {
+	return []byte(keyID + ":publicKey")
 }
 
 // Get извлекает ключи сервера по идентификатору keyID.
+// Ключи, сохраненные открытым текстом, при первом чтении шифруются и переносятся в новую запись.
 func (s *ServerKeysStorage) Get(keyID string) (*ServerKeys, error) {
-	var keys ServerKeys
-	err := s.db.View(func(txn *badger.Txn) error {
-		privItem, err := txn.Get([]byte(fmt.Sprintf("%s:privateKey", keyID)))
+	var keys *ServerKeys
+	err := s.store.View(func(tx database.Tx) error {
+		value, err := tx.Get(keysKey(keyID))
 		if err != nil {
 			return err
 		}
-		pubItem, err := txn.Get([]byte(fmt.Sprintf("%s:publicKey", keyID)))
+		keys, err = s.unwrap(keyID, value)
+		return err
+	})
+	if errors.Is(err, database.ErrKeyNotFound) {
+		return s.migrate(keyID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Set сохраняет ключи сервера по идентификатору keyID.
+func (s *ServerKeysStorage) Set(keyID string, keys *ServerKeys) error {
+	return s.put(keyID, keys, 0)
+}
+
+// Active возвращает текущий активный ключ сервера.
+// Если активный ключ не назначен, но есть ключ LegacyKeyID, он становится активным.
+func (s *ServerKeysStorage) Active() (*ServerKeys, error) {
+	var keyID string
+	err := s.store.View(func(tx database.Tx) error {
+		value, err := tx.Get([]byte(activeKeyIDKey))
+		keyID = string(value)
+		return err
+	})
+	if errors.Is(err, database.ErrKeyNotFound) {
+		if _, legacyErr := s.Get(LegacyKeyID); legacyErr != nil {
+			return nil, ErrNoActiveKey
+		}
+		err := s.store.Update(func(tx database.Tx) error {
+			return setActive(tx, LegacyKeyID, time.Time{})
+		})
 		if err != nil {
-			return err
+			return nil, err
 		}
-		privValue, err := privItem.ValueCopy(nil)
+		keyID = LegacyKeyID
+	} else if err != nil {
+		return nil, err
+	}
+
+	return s.Get(keyID)
+}
+
+// RotatedAt возвращает время последней ротации.
+// Для ключей, созданных до появления ротации, возвращается нулевое время.
+func (s *ServerKeysStorage) RotatedAt() (time.Time, error) {
+	var rotatedAt time.Time
+	err := s.store.View(func(tx database.Tx) error {
+		value, err := tx.Get([]byte(rotatedAtKey))
 		if err != nil {
 			return err
 		}
-		privBytes, err := hex.DecodeString(string(privValue))
+		return rotatedAt.UnmarshalText(value)
+	})
+	if errors.Is(err, database.ErrKeyNotFound) {
+		return time.Time{}, nil
+	}
+	return rotatedAt, err
+}
+
+// Rotate генерирует новый ключ и делает его активным.
+// Предыдущий ключ остается доступным в течение retainFor, чтобы сессии,
+// созданные с ним, дожили до своего истечения. Сохранение нового ключа,
+// его назначение и ограничение срока предыдущего выполняются в одной транзакции,
+// поэтому прерванная ротация не оставляет хранилище в промежуточном состоянии.
+func (s *ServerKeysStorage) Rotate(retainFor time.Duration) (*ServerKeys, error) {
+	// Active переносит ключи, сохраненные открытым текстом, в зашифрованную запись,
+	// чтобы предыдущий ключ можно было прочитать внутри транзакции.
+	if _, err := s.Active(); err != nil && !errors.Is(err, ErrNoActiveKey) {
+		return nil, err
+	}
+
+	keys, err := GenerateServerKeys()
+	if err != nil {
+		return nil, err
+	}
+	value, err := s.wrap(keys.ID, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.Update(func(tx database.Tx) error {
+		previousID, err := tx.Get([]byte(activeKeyIDKey))
+		if err != nil && !errors.Is(err, database.ErrKeyNotFound) {
+			return err
+		}
+		if len(previousID) > 0 {
+			previous, err := tx.Get(keysKey(string(previousID)))
+			if err != nil {
+				return fmt.Errorf("failed to read server keys %s: %w", previousID, err)
+			}
+			if err := tx.Set(keysKey(string(previousID)), previous, retainFor); err != nil {
+				return fmt.Errorf("failed to retire server keys %s: %w", previousID, err)
+			}
+		}
+
+		if err := tx.Set(keysKey(keys.ID), value, 0); err != nil {
+			return fmt.Errorf("failed to save server keys: %w", err)
+		}
+		if err := setActive(tx, keys.ID, time.Now()); err != nil {
+			return fmt.Errorf("failed to activate server keys: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// setActive назначает ключ keyID активным в транзакции tx и запоминает время ротации.
+func setActive(tx database.Tx, keyID string, rotatedAt time.Time) error {
+	rotatedAtText, err := rotatedAt.MarshalText()
+	if err != nil {
+		return err
+	}
+	if err := tx.Set([]byte(activeKeyIDKey), []byte(keyID), 0); err != nil {
+		return err
+	}
+	return tx.Set([]byte(rotatedAtKey), rotatedAtText, 0)
+}
+
+// Delete удаляет ключи сервера по идентификатору keyID,
+// включая записи, оставшиеся от хранения открытым текстом.
+func (s *ServerKeysStorage) Delete(keyID string) error {
+	return s.store.Update(func(tx database.Tx) error {
+		for _, key := range [][]byte{keysKey(keyID), legacyPrivateKey(keyID), legacyPublicKey(keyID)} {
+			if err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// put шифрует приватный ключ и сохраняет ключи сервера со сроком жизни ttl.
+func (s *ServerKeysStorage) put(keyID string, keys *ServerKeys, ttl time.Duration) error {
+	value, err := s.wrap(keyID, keys)
+	if err != nil {
+		return err
+	}
+	return s.store.Update(func(tx database.Tx) error {
+		return tx.Set(keysKey(keyID), value, ttl)
+	})
+}
+
+// migrate переносит ключи keyID, сохраненные открытым текстом, в зашифрованную запись.
+// Старые записи удаляются в той же транзакции. Срок жизни старых записей прочитать нельзя,
+// поэтому неактивный ключ получает срок SessionLifetime: этого достаточно для
+// сессий, созданных с ним.
+func (s *ServerKeysStorage) migrate(keyID string) (*ServerKeys, error) {
+	keys := &ServerKeys{ID: keyID}
+	err := s.store.Update(func(tx database.Tx) error {
+		privValue, err := tx.Get(legacyPrivateKey(keyID))
 		if err != nil {
 			return err
 		}
-		pubValue, err := pubItem.ValueCopy(nil)
+		pubValue, err := tx.Get(legacyPublicKey(keyID))
 		if err != nil {
 			return err
 		}
-		pubBytes, err := hex.DecodeString(string(pubValue))
+		if err := decodeKey(keys.PrivateKey[:], string(privValue)); err != nil {
+			return fmt.Errorf("invalid private key: %w", err)
+		}
+		if err := decodeKey(keys.PublicKey[:], string(pubValue)); err != nil {
+			return fmt.Errorf("invalid public key: %w", err)
+		}
+
+		activeID, err := tx.Get([]byte(activeKeyIDKey))
+		if err != nil && !errors.Is(err, database.ErrKeyNotFound) {
+			return err
+		}
+		ttl := SessionLifetime
+		if string(activeID) == keyID || (err != nil && keyID == LegacyKeyID) {
+			ttl = 0
+		}
+
+		value, err := s.wrap(keyID, keys)
 		if err != nil {
 			return err
 		}
-		copy(keys.PrivateKey[:], privBytes)
-		copy(keys.PublicKey[:], pubBytes)
-		return nil
+		if err := tx.Set(keysKey(keyID), value, ttl); err != nil {
+			return err
+		}
+		if err := tx.Delete(legacyPrivateKey(keyID)); err != nil {
+			return err
+		}
+		return tx.Delete(legacyPublicKey(keyID))
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &keys, nil
+	return keys, nil
 }
 
-// Set сохраняет ключи сервера по идентификатору keyID.
-func (s *ServerKeysStorage) Set(keyID string, keys *ServerKeys) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		privHex := hex.EncodeToString(keys.PrivateKey[:])
-		pubHex := hex.EncodeToString(keys.PublicKey[:])
-		if err := txn.Set([]byte(keyID+":privateKey"), []byte(privHex)); err != nil {
-			return err
-		}
-		return txn.Set([]byte(keyID+":publicKey"), []byte(pubHex))
+// wrap сериализует ключи сервера, шифруя приватный ключ.
+func (s *ServerKeysStorage) wrap(keyID string, keys *ServerKeys) ([]byte, error) {
+	wrapped, err := cryptography.EncryptAES(keys.PrivateKey[:], s.kek, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt private key: %w", err)
+	}
+	return json.Marshal(storedKeys{
+		PublicKey:  hex.EncodeToString(keys.PublicKey[:]),
+		PrivateKey: wrapped,
 	})
 }
 
-// Delete удаляет ключи сервера по идентификатору keyID.
-func (s *ServerKeysStorage) Delete(keyID string) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete([]byte(keyID + ":privateKey"))
-	})
+// unwrap восстанавливает ключи сервера из записи хранилища.
+func (s *ServerKeysStorage) unwrap(keyID string, value []byte) (*ServerKeys, error) {
+	var stored storedKeys
+	if err := json.Unmarshal(value, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode server keys: %w", err)
+	}
+
+	keys := &ServerKeys{ID: keyID}
+	if err := decodeKey(keys.PublicKey[:], stored.PublicKey); err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	privateKey, err := cryptography.DecryptAES(stored.PrivateKey, s.kek, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key (was the secret changed?): %w", err)
+	}
+	if len(privateKey) != len(keys.PrivateKey) {
+		return nil, fmt.Errorf("invalid private key length: %d", len(privateKey))
+	}
+	copy(keys.PrivateKey[:], privateKey)
+	return keys, nil
+}
+
+// decodeKey декодирует ключ из шестнадцатеричной строки value в dst.
+func decodeKey(dst []byte, value string) error {
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	if len(decoded) != len(dst) {
+		return fmt.Errorf("invalid key length: %d", len(decoded))
+	}
+	copy(dst, decoded)
+	return nil
 }
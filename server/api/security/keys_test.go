@@ -0,0 +1,170 @@
+package security
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"cu/common/cryptography"
+	"cu/server/api/database"
+)
+
+// failingStore отклоняет запись ключа failKey, имитируя сбой посреди транзакции.
+type failingStore struct {
+	database.Store
+	failKey []byte
+}
+
+func (s *failingStore) Update(fn func(tx database.Tx) error) error {
+	return s.Store.Update(func(tx database.Tx) error {
+		return fn(&failingTx{Tx: tx, failKey: s.failKey})
+	})
+}
+
+type failingTx struct {
+	database.Tx
+	failKey []byte
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (tx *failingTx) Set(key, value []byte, ttl time.Duration) error {
+	if bytes.Equal(key, tx.failKey) {
+		return errWriteFailed
+	}
+	return tx.Tx.Set(key, value, ttl)
+}
+
+// storedKeyIDs возвращает идентификаторы всех сохраненных ключей сервера.
+func storedKeyIDs(t *testing.T, store database.Store) []string {
+	t.Helper()
+	var ids []string
+	prefix := keysKey("")
+	err := store.View(func(tx database.Tx) error {
+		return tx.Scan(prefix, func(key, _ []byte) error {
+			ids = append(ids, string(key[len(prefix):]))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestRotate(t *testing.T) {
+	store, err := database.Open("badger", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	keys, err := NewServerKeysStorage(store, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := keys.Rotate(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := keys.Rotate(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := keys.Active()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.ID != second.ID {
+		t.Fatalf("active key is %s, want %s", active.ID, second.ID)
+	}
+	if previous, err := keys.Get(first.ID); err != nil || previous.PrivateKey != first.PrivateKey {
+		t.Fatalf("retired key is unavailable: %v", err)
+	}
+
+	// Ротация, прерванная при назначении нового ключа, не должна ничего изменить.
+	failing, err := NewServerKeysStorage(&failingStore{Store: store, failKey: []byte(activeKeyIDKey)}, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := storedKeyIDs(t, store)
+	if _, err := failing.Rotate(time.Nanosecond); !errors.Is(err, errWriteFailed) {
+		t.Fatalf("Rotate returned %v, want errWriteFailed", err)
+	}
+	if after := storedKeyIDs(t, store); len(after) != len(before) {
+		t.Fatalf("failed rotation left keys %v, had %v", after, before)
+	}
+	if active, err := keys.Active(); err != nil || active.ID != second.ID {
+		t.Fatalf("active key after failed rotation: %v, %v", active, err)
+	}
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	store, err := database.Open("badger", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// Ключи, сохраненные открытым текстом до появления ротации и шифрования.
+	privateKey, publicKey, err := cryptography.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(tx database.Tx) error {
+		if err := tx.Set(legacyPrivateKey(LegacyKeyID), []byte(hex.EncodeToString(privateKey[:])), 0); err != nil {
+			return err
+		}
+		return tx.Set(legacyPublicKey(LegacyKeyID), []byte(hex.EncodeToString(publicKey[:])), 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewServerKeysStorage(store, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := keys.Active()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.ID != LegacyKeyID || active.PrivateKey != privateKey || active.PublicKey != publicKey {
+		t.Fatalf("active key %s does not match the legacy keys", active.ID)
+	}
+
+	err = store.View(func(tx database.Tx) error {
+		for _, key := range [][]byte{legacyPrivateKey(LegacyKeyID), legacyPublicKey(LegacyKeyID)} {
+			if _, err := tx.Get(key); !errors.Is(err, database.ErrKeyNotFound) {
+				t.Errorf("legacy record %s was not deleted: %v", key, err)
+			}
+		}
+		value, err := tx.Get(keysKey(LegacyKeyID))
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(value, []byte(hex.EncodeToString(privateKey[:]))) {
+			t.Error("migrated record stores the private key in plain text")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if migrated, err := keys.Get(LegacyKeyID); err != nil || migrated.PrivateKey != privateKey || migrated.PublicKey != publicKey {
+		t.Fatalf("migrated keys do not round-trip: %v", err)
+	}
+
+	// Запись зашифрована ключом, выведенным из секрета, и не читается с другим секретом.
+	other, err := NewServerKeysStorage(store, []byte("other secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Get(LegacyKeyID); err == nil {
+		t.Fatal("migrated keys were unwrapped with a wrong secret")
+	}
+}
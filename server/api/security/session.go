@@ -2,58 +2,367 @@ package security
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
 	"time"
 
-	"github.com/dgraph-io/badger/v4"
+	"cu/common/cryptography"
+	"cu/common/protocol"
+	"cu/server/api/database"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrReplayedSequence возвращается, если порядковый номер сообщения уже использовался.
+	ErrReplayedSequence = errors.New("replayed sequence number")
+	// ErrSessionExpired возвращается для сессии, срок жизни которой истек.
+	ErrSessionExpired = errors.New("session expired")
+	// ErrInvalidEAPI возвращается, если EAPI не соответствует ключу доступа сессии.
+	ErrInvalidEAPI = errors.New("invalid EAPI")
 )
 
+// SessionLifetime — срок жизни сессии с момента последнего обращения.
+const SessionLifetime = 24 * time.Hour
+
+// sessionTouchInterval — минимальный период между продлениями сессии. Продление
+// переписывает сессию, поэтому частые запросы продлевают ее не чаще этого периода.
+const sessionTouchInterval = time.Minute
+
+// maxTouchRetries ограничивает число повторов продления сессии, прерванного
+// конфликтом с параллельной транзакцией.
+const maxTouchRetries = 3
+
 // ServerSession представляет сессию сервера.
 type ServerSession struct {
-	AccessKey []byte
-	LastUsed  time.Time
-	ExpiresAt time.Time
+	// Version — версия протокола, по которой создана сессия. Она определяет,
+	// как шифруются сообщения сессии.
+	Version int
+	// CipherSuite — набор шифров сообщений сессии. Пуст у сессий, созданных
+	// до выбора наборов, и тогда означает AES-256-GCM.
+	CipherSuite    cryptography.CipherSuite
+	AccessKey      []byte
+	KeyID          string
+	RoomID         string
+	TelegramUserID int64
+	ClientID       string
+	Sequence       uint64
+	LastUsed       time.Time
+	ExpiresAt      time.Time
+}
+
+// LogValue реализует slog.LogValuer. Ключ доступа в журнал не попадает.
+func (s *ServerSession) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("key_id", s.KeyID),
+		slog.String("room_id", s.RoomID),
+		slog.Int64("telegram_user_id", s.TelegramUserID),
+		slog.Time("expires_at", s.ExpiresAt),
+	)
+}
+
+// Seal шифрует сообщение сессии с заголовком header способом, который задает версия сессии.
+func (s *ServerSession) Seal(plainText []byte, header cryptography.MessageHeader) ([]byte, error) {
+	if s.Version < protocol.VersionBoundMessages {
+		return cryptography.SealAES(plainText, s.AccessKey, cryptography.SequenceData(header.Sequence))
+	}
+	return cryptography.SealMessage(plainText, s.AccessKey, s.cipherSuite(), header)
+}
+
+// Open расшифровывает сообщение сессии, зашифрованное клиентом с заголовком header.
+func (s *ServerSession) Open(cipherText []byte, header cryptography.MessageHeader) ([]byte, error) {
+	if s.Version < protocol.VersionBoundMessages {
+		return cryptography.OpenAES(cipherText, s.AccessKey, cryptography.SequenceData(header.Sequence))
+	}
+	return cryptography.OpenMessage(cipherText, s.AccessKey, s.cipherSuite(), header)
+}
+
+// cipherSuite возвращает набор шифров сообщений сессии.
+func (s *ServerSession) cipherSuite() cryptography.CipherSuite {
+	if s.CipherSuite == "" {
+		return cryptography.AES256GCM
+	}
+	return s.CipherSuite
 }
 
 // SessionStorage предоставляет методы для хранения и извлечения сессий.
 type SessionStorage struct {
-	db *badger.DB
+	store database.Store
 }
 
 // NewSessionStorage создает новый экземпляр SessionStorage.
-func NewSessionStorage(db *badger.DB) *SessionStorage {
-	return &SessionStorage{db: db}
+func NewSessionStorage(store database.Store) *SessionStorage {
+	return &SessionStorage{store: store}
+}
+
+// sessionKey возвращает ключ сессии в хранилище.
+func sessionKey(id string) []byte {
+	return []byte("session:" + id)
+}
+
+// clientSessionKey возвращает ключ записи индекса сессий клиента clientID.
+// Разделитель "/" не встречается в IP-адресах, в том числе IPv6.
+func clientSessionKey(clientID, id string) []byte {
+	return []byte("clientSession:" + clientID + "/" + id)
+}
+
+// MigrateLegacySessions переносит сессии, сохраненные до появления префикса "session:"
+// под ключом, равным идентификатору сессии, и возвращает число перенесенных сессий.
+// Истекшие сессии удаляются без переноса. Записи, ключ которых не является UUID
+// или значение не разбирается как сессия, не затрагиваются.
+func (s *SessionStorage) MigrateLegacySessions() (int, error) {
+	legacy := make(map[string]*ServerSession)
+	err := s.store.View(func(tx database.Tx) error {
+		return tx.Scan(nil, func(key, value []byte) error {
+			id := string(key)
+			if _, err := uuid.Parse(id); err != nil || len(id) != 36 {
+				return nil
+			}
+			if session, err := decodeSession(value); err == nil {
+				legacy[id] = session
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan legacy sessions: %w", err)
+	}
+
+	migrated := 0
+	err = s.store.Update(func(tx database.Tx) error {
+		for id, session := range legacy {
+			if time.Now().Before(session.ExpiresAt) {
+				if err := putSession(tx, id, session); err != nil {
+					return err
+				}
+				migrated++
+			}
+			if err := tx.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to migrate legacy sessions: %w", err)
+	}
+	return migrated, nil
 }
 
 // SaveSession сохраняет сессию в хранилище.
 func (s *SessionStorage) SaveSession(session *ServerSession, id string) error {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(session); err != nil {
-		return err
-	}
-	return s.db.Update(func(txn *badger.Txn) error {
-		return txn.SetEntry(badger.NewEntry([]byte(id), buf.Bytes()).WithTTL(time.Until(session.ExpiresAt)))
+	return s.store.Update(func(tx database.Tx) error {
+		return putSession(tx, id, session)
+	})
+}
+
+// CountClientSessions возвращает число действующих сессий клиента clientID.
+func (s *SessionStorage) CountClientSessions(clientID string) (int, error) {
+	var count int
+	err := s.store.View(func(tx database.Tx) error {
+		return tx.Scan(clientSessionKey(clientID, ""), func(_, _ []byte) error {
+			count++
+			return nil
+		})
 	})
+	return count, err
 }
 
 // GetSession извлекает сессию по идентификатору id.
 func (s *SessionStorage) GetSession(id string) (*ServerSession, error) {
-	var session ServerSession
-	err := s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(id))
+	var session *ServerSession
+	err := s.store.View(func(tx database.Tx) error {
+		value, err := tx.Get(sessionKey(id))
+		if err != nil {
+			return err
+		}
+		session, err = decodeSession(value)
+		return err
+	})
+	return session, err
+}
+
+// ListSessions вызывает fn для каждой действующей сессии.
+func (s *SessionStorage) ListSessions(fn func(id string, session *ServerSession) error) error {
+	prefix := sessionKey("")
+	return s.store.View(func(tx database.Tx) error {
+		return tx.Scan(prefix, func(key, value []byte) error {
+			session, err := decodeSession(value)
+			if err != nil {
+				return err
+			}
+			return fn(string(key[len(prefix):]), session)
+		})
+	})
+}
+
+// UpdateSession атомарно изменяет сессию id с помощью функции update.
+// Если update возвращает ошибку, сессия не изменяется.
+func (s *SessionStorage) UpdateSession(id string, update func(session *ServerSession) error) (*ServerSession, error) {
+	var session *ServerSession
+	err := s.store.Update(func(tx database.Tx) error {
+		value, err := tx.Get(sessionKey(id))
+		if err != nil {
+			return err
+		}
+
+		session, err = decodeSession(value)
 		if err != nil {
 			return err
 		}
-		return item.Value(func(val []byte) error {
-			return gob.NewDecoder(bytes.NewReader(val)).Decode(&session)
+
+		if err := update(session); err != nil {
+			return err
+		}
+		return putSession(tx, id, session)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// TouchSession отмечает использование сессии и продлевает ее срок жизни на SessionLifetime.
+// Сессия переписывается не чаще раза в sessionTouchInterval, поэтому LastUsed
+// может отставать от последнего обращения на этот период.
+// Истекшая сессия удаляется, и возвращается ErrSessionExpired.
+func (s *SessionStorage) TouchSession(id string) (*ServerSession, error) {
+	session, err := s.GetSession(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.touch(id, session)
+}
+
+// touch выполняет TouchSession для уже прочитанной сессии session.
+func (s *SessionStorage) touch(id string, session *ServerSession) (*ServerSession, error) {
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
+		s.DeleteSession(id)
+		return nil, ErrSessionExpired
+	}
+	if now.Sub(session.LastUsed) < sessionTouchInterval {
+		return session, nil
+	}
+
+	// Параллельные запросы одной сессии продлевают ее одновременно,
+	// поэтому проигравшая конфликт транзакция повторяется.
+	var err error
+	for attempt := 0; ; attempt++ {
+		session, err = s.UpdateSession(id, func(session *ServerSession) error {
+			now := time.Now()
+			if now.After(session.ExpiresAt) {
+				return ErrSessionExpired
+			}
+			session.LastUsed = now
+			session.ExpiresAt = now.Add(SessionLifetime)
+			return nil
 		})
+		if !errors.Is(err, database.ErrConflict) || attempt == maxTouchRetries {
+			break
+		}
+	}
+	if errors.Is(err, ErrSessionExpired) {
+		s.DeleteSession(id)
+	}
+	return session, err
+}
+
+// Authenticate проверяет EAPI для сессии sessionID.
+// EAPI принимается для текущего и предыдущего 30-секундного окна.
+// При успешной проверке срок жизни сессии продлевается, и возвращается обновленная сессия.
+func (s *SessionStorage) Authenticate(sessionID, receivedEAPI string) (*ServerSession, error) {
+	session, err := s.GetSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		s.DeleteSession(sessionID)
+		return nil, ErrSessionExpired
+	}
+
+	received, err := hex.DecodeString(receivedEAPI)
+	if err != nil {
+		return nil, ErrInvalidEAPI
+	}
+
+	currentTimestamp := time.Now().Unix() / 30
+	if !hmac.Equal(received, cryptography.ComputeEAPI(session.AccessKey, currentTimestamp)) &&
+		!hmac.Equal(received, cryptography.ComputeEAPI(session.AccessKey, currentTimestamp-1)) {
+		return nil, ErrInvalidEAPI
+	}
+
+	return s.touch(sessionID, session)
+}
+
+// AdvanceSequence принимает порядковый номер sequence сообщения клиента.
+// Номер должен быть строго больше последнего принятого, иначе сообщение
+// считается повтором и возвращается ErrReplayedSequence.
+func (s *SessionStorage) AdvanceSequence(id string, sequence uint64) error {
+	_, err := s.UpdateSession(id, func(session *ServerSession) error {
+		if sequence <= session.Sequence {
+			return ErrReplayedSequence
+		}
+		session.Sequence = sequence
+		return nil
 	})
-	return &session, err
+	return err
 }
 
 // DeleteSession удаляет сессию по идентификатору id.
 func (s *SessionStorage) DeleteSession(id string) error {
-	return s.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete([]byte(id))
+	return s.store.Update(func(tx database.Tx) error {
+		value, err := tx.Get(sessionKey(id))
+		if errors.Is(err, database.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if session, err := decodeSession(value); err == nil && session.ClientID != "" {
+			if err := tx.Delete(clientSessionKey(session.ClientID, id)); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(sessionKey(id))
 	})
 }
+
+// putSession сохраняет сессию и запись индекса ее клиента в рамках транзакции tx.
+// Обе записи истекают вместе с сессией.
+func putSession(tx database.Tx, id string, session *ServerSession) error {
+	value, err := encodeSession(session)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(session.ExpiresAt)
+	if session.ClientID != "" {
+		if err := tx.Set(clientSessionKey(session.ClientID, id), []byte(id), ttl); err != nil {
+			return err
+		}
+	}
+	return tx.Set(sessionKey(id), value, ttl)
+}
+
+// encodeSession сериализует сессию для хранилища.
+func encodeSession(session *ServerSession) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeSession восстанавливает сессию из значения хранилища.
+func decodeSession(value []byte) (*ServerSession, error) {
+	var session ServerSession
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
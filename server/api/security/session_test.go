@@ -0,0 +1,166 @@
+package security
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"cu/server/api/database"
+
+	"github.com/google/uuid"
+)
+
+func TestMigrateLegacySessions(t *testing.T) {
+	store, err := database.Open("badger", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	active := &ServerSession{AccessKey: []byte("access key"), ExpiresAt: time.Now().Add(time.Hour)}
+	expired := &ServerSession{AccessKey: []byte("access key"), ExpiresAt: time.Now().Add(-time.Hour)}
+	activeID, expiredID := uuid.New().String(), uuid.New().String()
+	err = store.Update(func(tx database.Tx) error {
+		for id, session := range map[string]*ServerSession{activeID: active, expiredID: expired} {
+			value, err := encodeSession(session)
+			if err != nil {
+				return err
+			}
+			if err := tx.Set([]byte(id), value, 0); err != nil {
+				return err
+			}
+		}
+		// Запись другого хранилища не должна быть затронута.
+		return tx.Set([]byte("activeKey"), []byte("key id"), 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := NewSessionStorage(store)
+	migrated, err := sessions.MigrateLegacySessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 1 {
+		t.Fatalf("migrated %d sessions, want 1", migrated)
+	}
+
+	session, err := sessions.GetSession(activeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(session.AccessKey) != string(active.AccessKey) {
+		t.Fatalf("migrated session has access key %q, want %q", session.AccessKey, active.AccessKey)
+	}
+	if _, err := sessions.GetSession(expiredID); !errors.Is(err, database.ErrKeyNotFound) {
+		t.Fatalf("expired session was migrated: %v", err)
+	}
+
+	err = store.View(func(tx database.Tx) error {
+		for _, id := range []string{activeID, expiredID} {
+			if _, err := tx.Get([]byte(id)); !errors.Is(err, database.ErrKeyNotFound) {
+				t.Errorf("legacy record %s was not deleted: %v", id, err)
+			}
+		}
+		_, err := tx.Get([]byte("activeKey"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if migrated, err := sessions.MigrateLegacySessions(); err != nil || migrated != 0 {
+		t.Fatalf("second migration returned %d, %v; want 0, nil", migrated, err)
+	}
+}
+
+func TestTouchSession(t *testing.T) {
+	store, err := database.Open("badger", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	sessions := NewSessionStorage(store)
+
+	now := time.Now()
+	tests := []struct {
+		name        string
+		session     ServerSession
+		wantExtends bool
+	}{
+		{"Recent", ServerSession{LastUsed: now.Add(-time.Second), ExpiresAt: now.Add(time.Hour)}, false},
+		{"Stale", ServerSession{LastUsed: now.Add(-2 * sessionTouchInterval), ExpiresAt: now.Add(time.Hour)}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := uuid.New().String()
+			if err := sessions.SaveSession(&test.session, id); err != nil {
+				t.Fatal(err)
+			}
+
+			touched, err := sessions.TouchSession(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, err := sessions.GetSession(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Недавно использованная сессия не переписывается.
+			extended := stored.ExpiresAt.After(test.session.ExpiresAt)
+			if extended != test.wantExtends {
+				t.Fatalf("stored session expires at %s, was %s; want extended %t", stored.ExpiresAt, test.session.ExpiresAt, test.wantExtends)
+			}
+			if !touched.ExpiresAt.Equal(stored.ExpiresAt) {
+				t.Fatalf("TouchSession returned expiry %s, stored %s", touched.ExpiresAt, stored.ExpiresAt)
+			}
+		})
+	}
+}
+
+// conflictStore завершает первые conflicts транзакций на запись ошибкой database.ErrConflict.
+type conflictStore struct {
+	database.Store
+	conflicts int
+}
+
+func (s *conflictStore) Update(fn func(tx database.Tx) error) error {
+	if s.conflicts > 0 {
+		s.conflicts--
+		return database.ErrConflict
+	}
+	return s.Store.Update(fn)
+}
+
+func TestTouchSessionRetriesConflict(t *testing.T) {
+	store, err := database.Open("badger", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	stale := &ServerSession{LastUsed: time.Now().Add(-2 * sessionTouchInterval), ExpiresAt: time.Now().Add(time.Hour)}
+	tests := []struct {
+		name      string
+		conflicts int
+		wantErr   error
+	}{
+		{"Retried", maxTouchRetries, nil},
+		{"GivesUp", maxTouchRetries + 1, database.ErrConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := uuid.New().String()
+			if err := NewSessionStorage(store).SaveSession(stale, id); err != nil {
+				t.Fatal(err)
+			}
+
+			sessions := NewSessionStorage(&conflictStore{Store: store, conflicts: test.conflicts})
+			if _, err := sessions.TouchSession(id); !errors.Is(err, test.wantErr) {
+				t.Fatalf("TouchSession returned %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -1 +1,119 @@
 package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTelegramHashMissing возвращается, если в initData нет подписи.
+	ErrTelegramHashMissing = errors.New("telegram init data has no hash")
+	// ErrTelegramHashInvalid возвращается, если подпись initData не совпала.
+	ErrTelegramHashInvalid = errors.New("telegram init data hash is invalid")
+	// ErrTelegramExpired возвращается, если auth_date слишком старый или из будущего.
+	ErrTelegramExpired = errors.New("telegram init data is expired")
+	// ErrTelegramUserMissing возвращается, если в initData нет пользователя.
+	ErrTelegramUserMissing = errors.New("telegram init data has no user")
+)
+
+// TelegramUser представляет пользователя Telegram из initData WebApp.
+type TelegramUser struct {
+	ID           int64  `json:"id"`
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name,omitempty"`
+	Username     string `json:"username,omitempty"`
+	LanguageCode string `json:"language_code,omitempty"`
+}
+
+// TelegramValidator проверяет initData, которые Telegram передает WebApp.
+type TelegramValidator struct {
+	botToken string
+	maxAge   time.Duration
+}
+
+// NewTelegramValidator создает валидатор для бота с токеном botToken.
+// Данные старше maxAge считаются устаревшими.
+func NewTelegramValidator(botToken string, maxAge time.Duration) *TelegramValidator {
+	return &TelegramValidator{botToken: botToken, maxAge: maxAge}
+}
+
+// Validate проверяет подпись и свежесть initData и возвращает пользователя.
+func (v *TelegramValidator) Validate(initData string) (*TelegramUser, error) {
+	return v.ValidateAt(initData, time.Now())
+}
+
+// ValidateAt проверяет initData относительно момента now.
+// Позволяет проверять заранее подготовленные данные без сети и без зависимости от часов.
+func (v *TelegramValidator) ValidateAt(initData string, now time.Time) (*TelegramUser, error) {
+	values, err := url.ParseQuery(initData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse telegram init data: %w", err)
+	}
+
+	receivedHash, err := hex.DecodeString(values.Get("hash"))
+	if err != nil || len(receivedHash) == 0 {
+		return nil, ErrTelegramHashMissing
+	}
+
+	expectedHash, err := hex.DecodeString(SignTelegramInitData(values, v.botToken))
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(receivedHash, expectedHash) {
+		return nil, ErrTelegramHashInvalid
+	}
+
+	authDate, err := strconv.ParseInt(values.Get("auth_date"), 10, 64)
+	if err != nil {
+		return nil, ErrTelegramExpired
+	}
+	age := now.Sub(time.Unix(authDate, 0))
+	if age < -time.Minute || age > v.maxAge {
+		return nil, ErrTelegramExpired
+	}
+
+	userJSON := values.Get("user")
+	if userJSON == "" {
+		return nil, ErrTelegramUserMissing
+	}
+	var user TelegramUser
+	if err := json.Unmarshal([]byte(userJSON), &user); err != nil {
+		return nil, fmt.Errorf("failed to decode telegram user: %w", err)
+	}
+	if user.ID == 0 {
+		return nil, ErrTelegramUserMissing
+	}
+
+	return &user, nil
+}
+
+// SignTelegramInitData вычисляет подпись initData так же, как это делает Telegram:
+// HMAC-SHA256 от отсортированных пар "ключ=значение" без поля hash
+// на ключе HMAC-SHA256("WebAppData", botToken). Возвращает подпись в виде hex-строки.
+// Используется для проверки и для подготовки тестовых данных.
+func SignTelegramInitData(values url.Values, botToken string) string {
+	pairs := make([]string, 0, len(values))
+	for key := range values {
+		if key == "hash" {
+			continue
+		}
+		pairs = append(pairs, key+"="+values.Get(key))
+	}
+	sort.Strings(pairs)
+
+	secret := hmac.New(sha256.New, []byte("WebAppData"))
+	secret.Write([]byte(botToken))
+
+	h := hmac.New(sha256.New, secret.Sum(nil))
+	h.Write([]byte(strings.Join(pairs, "\n")))
+	return hex.EncodeToString(h.Sum(nil))
+}
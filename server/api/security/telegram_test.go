@@ -0,0 +1,82 @@
+package security
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testBotToken = "123456:test-bot-token"
+
+// signedInitData возвращает initData с полями fields, подписанные токеном testBotToken.
+func signedInitData(fields url.Values) string {
+	return signedInitDataWith(fields, testBotToken)
+}
+
+func TestTelegramValidateAt(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	authDate := strconv.FormatInt(now.Unix(), 10)
+	user := `{"id":42,"first_name":"Ann","username":"ann"}`
+	validator := NewTelegramValidator(testBotToken, time.Hour)
+
+	valid := signedInitData(url.Values{"auth_date": {authDate}, "query_id": {"AAE"}, "user": {user}})
+	tampered, err := url.ParseQuery(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.Set("user", `{"id":43,"first_name":"Ann","username":"ann"}`)
+
+	tests := []struct {
+		name     string
+		initData string
+		now      time.Time
+		wantErr  error
+	}{
+		{"Valid", valid, now.Add(time.Minute), nil},
+		{"ValidWithClockSkew", valid, now.Add(-30 * time.Second), nil},
+		{"TamperedHash", tampered.Encode(), now, ErrTelegramHashInvalid},
+		{"WrongBotToken", signedInitDataWith(url.Values{"auth_date": {authDate}, "user": {user}}, "654321:other"), now, ErrTelegramHashInvalid},
+		{"Expired", valid, now.Add(time.Hour + time.Second), ErrTelegramExpired},
+		{"FromFuture", valid, now.Add(-2 * time.Minute), ErrTelegramExpired},
+		{"MissingAuthDate", signedInitData(url.Values{"user": {user}}), now, ErrTelegramExpired},
+		{"MissingUser", signedInitData(url.Values{"auth_date": {authDate}}), now, ErrTelegramUserMissing},
+		{"UserWithoutID", signedInitData(url.Values{"auth_date": {authDate}, "user": {`{"first_name":"Ann"}`}}), now, ErrTelegramUserMissing},
+		{"MissingHash", url.Values{"auth_date": {authDate}, "user": {user}}.Encode(), now, ErrTelegramHashMissing},
+		{"MalformedHash", url.Values{"auth_date": {authDate}, "user": {user}, "hash": {"not-hex"}}.Encode(), now, ErrTelegramHashMissing},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := validator.ValidateAt(test.initData, test.now)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("ValidateAt returned %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr != nil {
+				return
+			}
+			if got.ID != 42 || got.FirstName != "Ann" || got.Username != "ann" {
+				t.Fatalf("ValidateAt returned user %+v", got)
+			}
+		})
+	}
+}
+
+func TestSignTelegramInitDataIgnoresHash(t *testing.T) {
+	values := url.Values{"auth_date": {"1700000000"}, "user": {`{"id":42}`}, "query_id": {"AAE"}}
+	signature := SignTelegramInitData(values, testBotToken)
+
+	values.Set("hash", "00")
+	if got := SignTelegramInitData(values, testBotToken); got != signature {
+		t.Fatalf("signature depends on the hash field: %s != %s", got, signature)
+	}
+	if got := SignTelegramInitData(values, "654321:other"); got == signature {
+		t.Fatal("signature does not depend on the bot token")
+	}
+}
+
+// signedInitDataWith возвращает initData с полями fields, подписанные токеном botToken.
+func signedInitDataWith(fields url.Values, botToken string) string {
+	fields.Set("hash", SignTelegramInitData(fields, botToken))
+	return fields.Encode()
+}
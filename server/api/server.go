@@ -1,92 +1,213 @@
 package api
 
 import (
-	"cu/common/cryptography"
+	"context"
+	"crypto/ed25519"
 	"cu/server/api/database"
+	"cu/server/api/logging"
 	"cu/server/api/router"
 	"cu/server/api/security"
 	"cu/server/config"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-// Init инициализирует конфигурацию приложения.
-// Загружает конфигурацию из файла или переменных окружения.
-func Init() {
-	config.Load()
-	log.Println("Configuration loaded successfully")
-}
+// Тайм-ауты HTTP-сервера. На WebSocket-туннели они не распространяются:
+// после захвата соединения сроки чтения и записи сбрасываются.
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
+
+	// shutdownTimeout ограничивает время на завершение обрабатываемых запросов
+	// и закрытие туннелей при остановке сервера.
+	shutdownTimeout = 30 * time.Second
+)
 
-// startServer запускает HTTP-сервер на указанном порту.
+// StartServer запускает HTTP-сервер с конфигурацией cfg.
 // Инициализирует базу данных, ключи сервера и роутер.
-func StartServer(port int) {
-	log.Println("Initializing BadgerDB...")
-	db, err := database.NewBadgerDB()
+// По сигналу SIGINT или SIGTERM сервер перестает принимать соединения,
+// дожидается завершения обрабатываемых запросов, закрывает туннели, останавливает
+// ротацию ключей и закрывает базу данных.
+func StartServer(cfg *config.Config) (err error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("Initializing database...", slog.String("driver", cfg.Database.Driver))
+	db, err := database.Open(cfg.Database.Driver, cfg.Database.DataSource())
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		return fmt.Errorf("failed to initialize database: %w", err)
 	}
-	log.Println("Database initialized successfully")
+	defer func() {
+		slog.Info("Closing database...")
+		if closeErr := db.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close database: %w", closeErr))
+		}
+	}()
+	slog.Info("Database initialized successfully")
 
 	// Инициализация хранилища ключей сервера.
-	log.Println("Initializing server keys storage...")
-	serverKeysStorage := security.NewServerKeysStorage(db)
+	slog.Info("Initializing server keys storage...")
+	serverKeysStorage, err := security.NewServerKeysStorage(db, cfg.Secret)
+	if err != nil {
+		return fmt.Errorf("failed to initialize server keys storage: %w", err)
+	}
 
 	// Получение или генерация ключей сервера.
-	log.Println("Retrieving or generating server keys...")
+	slog.Info("Retrieving or generating server keys...")
 	serverKeys, err := getOrGenerateServerKeys(serverKeysStorage)
 	if err != nil {
-		log.Fatalf("Failed to retrieve or generate server keys: %v", err)
+		return fmt.Errorf("failed to retrieve or generate server keys: %w", err)
+	}
+	slog.Info("Server key loaded", slog.String("key_id", serverKeys.ID), slog.String("public_key", hex.EncodeToString(serverKeys.PublicKey[:])))
+
+	// Ключ подписи сервера создается один раз; его публичную часть нужно встроить в клиент.
+	identity, err := serverKeysStorage.Identity()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve or generate server identity key: %w", err)
 	}
-	log.Printf("Server public key: %s", hex.EncodeToString(serverKeys.PublicKey[:]))
+	slog.Info("Server identity key loaded", slog.String("public_key", hex.EncodeToString(identity.Public().(ed25519.PublicKey))))
 
-	// Инициализация роутера с ключами сервера и базой данных.
-	log.Println("Setting up router...")
-	router := router.NewRouter(serverKeys.PrivateKey, serverKeys.PublicKey, db)
+	// Сессии, сохраненные до появления префикса ключей, переносятся, чтобы клиенты не потеряли их.
+	migrated, err := security.NewSessionStorage(db).MigrateLegacySessions()
+	if err != nil {
+		return err
+	}
+	if migrated > 0 {
+		slog.Info("Legacy sessions migrated", slog.Int("count", migrated))
+	}
+
+	// Запуск плановой ротации ключей сервера.
+	if cfg.Keys.RotationInterval > 0 {
+		slog.Info("Scheduling server key rotation", slog.Duration("interval", cfg.Keys.RotationInterval))
+		rotationCtx, cancelRotation := context.WithCancel(ctx)
+		rotationDone := make(chan struct{})
+		go func() {
+			defer close(rotationDone)
+			scheduleKeyRotation(rotationCtx, serverKeysStorage, cfg.Keys.RotationInterval)
+		}()
+		// Отложенные вызовы выполняются в обратном порядке, поэтому база данных
+		// закрывается только после того, как ротация остановится.
+		defer func() {
+			cancelRotation()
+			<-rotationDone
+		}()
+	}
+
+	// Инициализация роутера с конфигурацией, хранилищем ключей сервера и базой данных.
+	slog.Info("Setting up router...")
+	router := router.NewRouter(cfg, serverKeysStorage, db)
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           router.SetupRoutes(),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
 
 	// Запуск HTTP-сервера.
-	log.Printf("Starting server on port :%d\n", port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), router.SetupRoutes()); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	slog.Info("Starting server", slog.Int("port", cfg.Port), slog.String("profile", cfg.Profile))
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return fmt.Errorf("failed to start server: %w", err)
+	case <-ctx.Done():
 	}
+	stop()
+
+	slog.Info("Shutting down server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Туннели закрываются параллельно с завершением обычных запросов:
+	// Shutdown не отслеживает захваченные WebSocket-соединения. Hub.Shutdown
+	// дожидается обработчиков туннелей, поэтому база данных закрывается после них.
+	tunnelsErr := make(chan error, 1)
+	go func() {
+		tunnelsErr <- router.Tunnels().Shutdown(shutdownCtx)
+	}()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to drain in-flight requests", logging.Error(err))
+	}
+	if err := <-tunnelsErr; err != nil {
+		slog.Error("Failed to close tunnels gracefully", logging.Error(err))
+	}
+
+	slog.Info("Server stopped")
+	return nil
 }
 
-// getOrGenerateServerKeys извлекает ключи сервера из хранилища или генерирует новые.
-// Если ключи не найдены в хранилище, они генерируются и сохраняются.
+// getOrGenerateServerKeys извлекает активные ключи сервера из хранилища или генерирует новые.
+// Если активный ключ не найден в хранилище, он генерируется и сохраняется.
 func getOrGenerateServerKeys(storage *security.ServerKeysStorage) (*security.ServerKeys, error) {
-	log.Println("Attempting to retrieve server keys from storage...")
-	serverKeys, err := storage.Get("production")
-	if err != nil {
-		log.Println("Server keys not found in storage, generating new keys...")
-		serverKeys, err = generateServerKeys()
+	slog.Info("Attempting to retrieve server keys from storage...")
+	serverKeys, err := storage.Active()
+	if errors.Is(err, security.ErrNoActiveKey) {
+		slog.Info("Server keys not found in storage, generating new keys...")
+		serverKeys, err = storage.Rotate(security.SessionLifetime)
 		if err != nil {
 			return nil, fmt.Errorf("failed to generate server keys: %v", err)
 		}
-
-		log.Println("Saving generated server keys to storage...")
-		if err := storage.Set("production", serverKeys); err != nil {
-			return nil, fmt.Errorf("failed to save server keys: %v", err)
-		}
-		log.Println("Server keys saved successfully")
+		slog.Info("Server keys saved successfully")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to retrieve server keys: %v", err)
 	}
 
-	log.Println("Server keys retrieved or generated successfully")
+	slog.Info("Server keys retrieved or generated successfully")
 	return serverKeys, nil
 }
 
-// generateServerKeys генерирует новую пару приватного и публичного ключей.
-// Возвращает структуру ServerKeys с ключами или ошибку, если генерация не удалась.
-func generateServerKeys() (*security.ServerKeys, error) {
-	log.Println("Generating new server keys...")
-	privateKey, publicKey, err := cryptography.GenerateKeyPair()
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate key pair: %v", err)
+// scheduleKeyRotation периодически заменяет активный ключ сервера.
+// Предыдущие ключи хранятся, пока не истекут созданные с ними сессии.
+// Ротация прекращается при отмене контекста ctx.
+func scheduleKeyRotation(ctx context.Context, storage *security.ServerKeysStorage, interval time.Duration) {
+	for {
+		rotatedAt, err := storage.RotatedAt()
+		if err != nil {
+			slog.Error("Failed to read last key rotation time", logging.Error(err))
+			rotatedAt = time.Now()
+		}
+
+		if !sleep(ctx, time.Until(rotatedAt.Add(interval))) {
+			return
+		}
+
+		serverKeys, err := storage.Rotate(security.SessionLifetime)
+		if err != nil {
+			slog.Error("Failed to rotate server keys", logging.Error(err))
+			if !sleep(ctx, time.Minute) {
+				return
+			}
+			continue
+		}
+		slog.Info("Server keys rotated", slog.String("key_id", serverKeys.ID))
 	}
+}
 
-	log.Println("Server keys generated successfully")
-	return &security.ServerKeys{
-		PrivateKey: privateKey,
-		PublicKey:  publicKey,
-	}, nil
+// sleep ожидает в течение d и возвращает false, если контекст ctx был отменен раньше.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
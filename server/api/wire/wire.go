@@ -0,0 +1,83 @@
+package wire
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"cu/common/protocol"
+	"cu/server/api/logging"
+)
+
+// maxRequestSize ограничивает размер тела запроса с конвертом.
+const maxRequestSize = 1 << 20
+
+// Message — конверт протокола, версию которого можно проверить.
+type Message interface {
+	CheckVersion() error
+}
+
+// Decode читает из тела запроса r конверт v в формате, указанном в заголовке Content-Type.
+// Запрос без Content-Type читается как JSON. Если конверт не удалось прочитать
+// или его версия не поддерживается, Decode сам отвечает клиенту ошибкой и возвращает false.
+func Decode(w http.ResponseWriter, r *http.Request, v Message) bool {
+	codec := protocol.JSON
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var ok bool
+		if codec, ok = protocol.CodecFor(contentType); !ok {
+			Error(w, r, http.StatusUnsupportedMediaType, protocol.CodeUnsupportedMediaType, "Unsupported Content-Type")
+			return false
+		}
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Unable to read request body", logging.Error(err))
+		Error(w, r, http.StatusBadRequest, protocol.CodeBadRequest, "Unable to read request body")
+		return false
+	}
+	if err := codec.Unmarshal(data, v); err != nil {
+		logging.FromContext(r.Context()).Warn("Unable to decode request", logging.Error(err))
+		Error(w, r, http.StatusBadRequest, protocol.CodeBadRequest, "Unable to decode request")
+		return false
+	}
+
+	if err := v.CheckVersion(); err != nil {
+		var protocolErr *protocol.Error
+		if !errors.As(err, &protocolErr) {
+			protocolErr = protocol.NewError(protocol.CodeBadRequest, err.Error())
+		}
+		WriteError(w, r, http.StatusBadRequest, protocolErr)
+		return false
+	}
+	return true
+}
+
+// Write отвечает клиенту статусом status и конвертом v в формате,
+// выбранном по заголовку Accept запроса.
+func Write(w http.ResponseWriter, r *http.Request, status int, v any) {
+	codec := protocol.Negotiate(r.Header.Get("Accept"))
+	data, err := codec.Marshal(v)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Unable to encode response", logging.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		logging.FromContext(r.Context()).Debug("Unable to write response", logging.Error(err))
+	}
+}
+
+// Error отвечает клиенту статусом status и конвертом ошибки с кодом code и текстом message.
+func Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	WriteError(w, r, status, protocol.NewError(code, message))
+}
+
+// WriteError отвечает клиенту статусом status и конвертом ошибки err.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, err *protocol.Error) {
+	Write(w, r, status, protocol.NewErrorResponse(err))
+}
@@ -0,0 +1,40 @@
+package buildinfo
+
+import "runtime/debug"
+
+// Version — версия сервера. Задается при сборке:
+//
+//	go build -ldflags "-X cu/server/buildinfo.Version=v1.2.3"
+var Version = "dev"
+
+// Info описывает сборку сервера.
+type Info struct {
+	Version   string `json:"Version"`
+	GoVersion string `json:"GoVersion"`
+	Revision  string `json:"Revision,omitempty"`
+	Time      string `json:"Time,omitempty"`
+	Modified  bool   `json:"Modified"`
+}
+
+// Read возвращает сведения о сборке. Ревизия и время коммита берутся
+// из информации о системе контроля версий, которую записывает go build.
+func Read() Info {
+	info := Info{Version: Version}
+
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.GoVersion = build.GoVersion
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.Time = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
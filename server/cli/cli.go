@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"cu/server/api/database"
+	"cu/server/config"
+)
+
+// ErrUsage возвращается при неизвестной команде или неверных аргументах.
+var ErrUsage = errors.New("invalid usage")
+
+// usage — справка по административным командам.
+const usage = `Usage: server [flags] <command> [arguments]
+
+Commands:
+  serve                     start the HTTP server (default)
+  keys show                 show the active server key
+  keys rotate               generate and activate a new server key
+  keys export [-private]    print server keys as JSON
+  keys identity             print the server identity key to pin in the client
+  sessions list             list active sessions
+  sessions revoke <id>...   delete sessions and remove them from their rooms
+  sessions purge-expired    delete sessions past their expiry time
+  db backup <file>          write a Badger backup to file
+  db restore [-force] <file>
+                            load a Badger backup from file into an empty database
+  db gc                     reclaim space taken by deleted and expired entries
+  config check              validate the configuration and print it
+
+Run "server -h" for the list of configuration flags.
+`
+
+// command — обработчик административной команды.
+type command func(cfg *config.Config, args []string, out io.Writer) error
+
+// commands сопоставляет команды и подкоманды их обработчикам.
+var commands = map[string]map[string]command{
+	"keys": {
+		"show":     keysShow,
+		"rotate":   keysRotate,
+		"export":   keysExport,
+		"identity": keysIdentity,
+	},
+	"sessions": {
+		"list":          sessionsList,
+		"revoke":        sessionsRevoke,
+		"purge-expired": sessionsPurgeExpired,
+	},
+	"db": {
+		"backup":  dbBackup,
+		"restore": dbRestore,
+		"gc":      dbGC,
+	},
+}
+
+// IsCommand сообщает, является ли args административной командой.
+// Пустые аргументы и команда serve запускают сервер.
+func IsCommand(args []string) bool {
+	return len(args) > 0 && args[0] != "serve"
+}
+
+// Run выполняет административную команду args с конфигурацией cfg
+// и выводит результат в out. configErr — ошибка загрузки конфигурации:
+// ее сообщает config check, а остальные команды с ней не выполняются.
+func Run(cfg *config.Config, configErr error, args []string, out io.Writer) error {
+	if len(args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		return ErrUsage
+	}
+	if args[0] == "config" && args[1] == "check" {
+		return configCheck(cfg, configErr, out)
+	}
+
+	handler, ok := commands[args[0]][args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("%w: unknown command %q", ErrUsage, args[0]+" "+args[1])
+	}
+	if configErr != nil {
+		return fmt.Errorf("invalid configuration: %w", configErr)
+	}
+	return handler(cfg, args[2:], out)
+}
+
+// openStore открывает хранилище, указанное в конфигурации.
+// Badger не допускает одновременной работы двух процессов с одной базой,
+// поэтому для него команды выполняются при остановленном сервере.
+func openStore(cfg *config.Config) (database.Store, error) {
+	store, err := database.Open(cfg.Database.Driver, cfg.Database.DataSource())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database (is the server still running?): %w", cfg.Database.Driver, err)
+	}
+	return store, nil
+}
+
+// withStore открывает хранилище, выполняет fn и закрывает хранилище.
+func withStore(cfg *config.Config, fn func(store database.Store) error) error {
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	return errors.Join(fn(store), store.Close())
+}
+
+// newTable создает писатель для вывода таблицы с выровненными столбцами.
+func newTable(out io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+}
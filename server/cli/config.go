@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"cu/server/config"
+)
+
+// configCheck выводит загруженную конфигурацию без секретов и ошибки ее проверки.
+func configCheck(cfg *config.Config, configErr error, out io.Writer) error {
+	if cfg == nil {
+		return configErr
+	}
+
+	table := newTable(out)
+	row := func(name string, value any) {
+		fmt.Fprintf(table, "%s\t%v\n", name, value)
+	}
+	row("Profile", cfg.Profile)
+	row("Port", cfg.Port)
+	row("LogLevel", cfg.LogLevel)
+	row("Secret", redact(string(cfg.Secret)))
+	row("TrustedProxies", cfg.TrustedProxies)
+	row("Database.Driver", cfg.Database.Driver)
+	if cfg.Database.Driver == "postgres" {
+		row("Database.Host", cfg.Database.Host)
+		row("Database.Port", cfg.Database.Port)
+		row("Database.User", cfg.Database.User)
+		row("Database.Password", redact(cfg.Database.Password))
+		row("Database.Name", cfg.Database.Name)
+		row("Database.SSLMode", cfg.Database.SSLMode)
+	} else {
+		row("Database.Path", cfg.Database.Path)
+	}
+	row("Rooms.Capacity", cfg.Rooms.Capacity)
+	row("Rooms.IdleTimeout", cfg.Rooms.IdleTimeout)
+	row("Keys.RotationInterval", cfg.Keys.RotationInterval)
+	row("Telegram.BotToken", redact(cfg.Telegram.BotToken))
+	row("Telegram.AuthMaxAge", cfg.Telegram.AuthMaxAge)
+	row("RateLimit.IPRate", cfg.RateLimit.IPRate)
+	row("RateLimit.IPBurst", cfg.RateLimit.IPBurst)
+	row("RateLimit.SessionRate", cfg.RateLimit.SessionRate)
+	row("RateLimit.SessionBurst", cfg.RateLimit.SessionBurst)
+	row("RateLimit.MaxSessionsPerClient", cfg.RateLimit.MaxSessionsPerClient)
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	if configErr != nil {
+		return fmt.Errorf("configuration is invalid:\n%w", configErr)
+	}
+	fmt.Fprintln(out, "Configuration is valid")
+	return nil
+}
+
+// redact скрывает значение секрета, сообщая только, задан ли он.
+func redact(secret string) string {
+	if strings.TrimSpace(secret) == "" {
+		return "(not set)"
+	}
+	return "(set)"
+}
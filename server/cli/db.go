@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"cu/server/api/database"
+	"cu/server/config"
+)
+
+// maxPendingWrites ограничивает число незафиксированных записей при восстановлении Badger.
+const maxPendingWrites = 256
+
+// errNotBadger возвращается командами резервного копирования для других хранилищ.
+var errNotBadger = errors.New("backup and restore are only supported for the badger driver; use the database's own tools")
+
+// dbBackup записывает полную резервную копию базы Badger в файл.
+func dbBackup(cfg *config.Config, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: db backup requires a file name", ErrUsage)
+	}
+	if cfg.Database.Driver != "badger" {
+		return errNotBadger
+	}
+
+	file, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+
+	err = withStore(cfg, func(store database.Store) error {
+		_, err := store.(*database.BadgerStore).DB().Backup(file, 0)
+		return err
+	})
+	if err = errors.Join(err, file.Close()); err != nil {
+		os.Remove(args[0])
+		return fmt.Errorf("failed to back up database: %w", err)
+	}
+
+	fmt.Fprintf(out, "Database backed up to %s\n", args[0])
+	return nil
+}
+
+// dbRestore загружает резервную копию Badger из файла.
+// Без флага -force восстановление выполняется только в пустую базу,
+// чтобы не смешать копию с текущими данными.
+func dbRestore(cfg *config.Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("db restore", flag.ContinueOnError)
+	force := flags.Bool("force", false, "restore into a database that already has data")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("%w: db restore requires a file name", ErrUsage)
+	}
+	if cfg.Database.Driver != "badger" {
+		return errNotBadger
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer file.Close()
+
+	err = withStore(cfg, func(store database.Store) error {
+		if !*force {
+			empty, err := isEmpty(store)
+			if err != nil {
+				return err
+			}
+			if !empty {
+				return errors.New("database is not empty, use -force to restore anyway")
+			}
+		}
+		return store.(*database.BadgerStore).DB().Load(file, maxPendingWrites)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore database: %w", err)
+	}
+
+	fmt.Fprintf(out, "Database restored from %s\n", flags.Arg(0))
+	return nil
+}
+
+// errStopScan прерывает обход хранилища.
+var errStopScan = errors.New("stop scan")
+
+// isEmpty сообщает, что в хранилище нет ни одной записи.
+func isEmpty(store database.Store) (bool, error) {
+	empty := true
+	err := store.View(func(tx database.Tx) error {
+		return tx.Scan(nil, func(_, _ []byte) error {
+			empty = false
+			return errStopScan
+		})
+	})
+	if err != nil && !errors.Is(err, errStopScan) {
+		return false, err
+	}
+	return empty, nil
+}
+
+// dbGC освобождает место, занятое удаленными и истекшими записями.
+func dbGC(cfg *config.Config, _ []string, out io.Writer) error {
+	return withStore(cfg, func(store database.Store) error {
+		collector, ok := store.(database.GarbageCollector)
+		if !ok {
+			return fmt.Errorf("the %s driver does not support garbage collection", cfg.Database.Driver)
+		}
+		if err := collector.CollectGarbage(); err != nil {
+			return fmt.Errorf("failed to collect garbage: %w", err)
+		}
+		fmt.Fprintln(out, "Garbage collection completed")
+		return nil
+	})
+}
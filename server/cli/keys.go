@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"cu/server/api/database"
+	"cu/server/api/security"
+	"cu/server/config"
+)
+
+// keysShow выводит активный ключ сервера.
+func keysShow(cfg *config.Config, _ []string, out io.Writer) error {
+	return withStore(cfg, func(store database.Store) error {
+		storage, err := security.NewServerKeysStorage(store, cfg.Secret)
+		if err != nil {
+			return err
+		}
+		keys, err := storage.Active()
+		if err != nil {
+			return fmt.Errorf("failed to load active server key: %w", err)
+		}
+		rotatedAt, err := storage.RotatedAt()
+		if err != nil {
+			return fmt.Errorf("failed to read last key rotation time: %w", err)
+		}
+
+		table := newTable(out)
+		fmt.Fprintf(table, "ID\t%s\n", keys.ID)
+		fmt.Fprintf(table, "PublicKey\t%s\n", hex.EncodeToString(keys.PublicKey[:]))
+		fmt.Fprintf(table, "Fingerprint\t%s\n", keys.Fingerprint())
+		fmt.Fprintf(table, "RotatedAt\t%s\n", formatTime(rotatedAt))
+		return table.Flush()
+	})
+}
+
+// keysRotate создает и активирует новый ключ сервера.
+// Предыдущий ключ хранится, пока не истекут созданные с ним сессии.
+func keysRotate(cfg *config.Config, _ []string, out io.Writer) error {
+	return withStore(cfg, func(store database.Store) error {
+		storage, err := security.NewServerKeysStorage(store, cfg.Secret)
+		if err != nil {
+			return err
+		}
+		keys, err := storage.Rotate(security.SessionLifetime)
+		if err != nil {
+			return fmt.Errorf("failed to rotate server keys: %w", err)
+		}
+		fmt.Fprintf(out, "Server keys rotated, active key: %s (%s)\n", keys.ID, keys.Fingerprint())
+		return nil
+	})
+}
+
+// exportedKey описывает ключ сервера в выводе keys export.
+type exportedKey struct {
+	ID          string `json:"ID"`
+	PublicKey   string `json:"PublicKey"`
+	Fingerprint string `json:"Fingerprint"`
+	PrivateKey  string `json:"PrivateKey,omitempty"`
+}
+
+// keysExport выводит активный ключ сервера в формате JSON.
+// Приватный ключ выводится только с флагом -private.
+func keysExport(cfg *config.Config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("keys export", flag.ContinueOnError)
+	private := flags.Bool("private", false, "include the private key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	return withStore(cfg, func(store database.Store) error {
+		storage, err := security.NewServerKeysStorage(store, cfg.Secret)
+		if err != nil {
+			return err
+		}
+		keys, err := storage.Active()
+		if err != nil {
+			return fmt.Errorf("failed to load active server key: %w", err)
+		}
+
+		exported := exportedKey{
+			ID:          keys.ID,
+			PublicKey:   hex.EncodeToString(keys.PublicKey[:]),
+			Fingerprint: keys.Fingerprint(),
+		}
+		if *private {
+			exported.PrivateKey = hex.EncodeToString(keys.PrivateKey[:])
+		}
+
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(exported)
+	})
+}
+
+// keysIdentity выводит публичный ключ подписи сервера и флаг сборки клиента,
+// который встраивает этот ключ. Если ключа еще нет, он создается.
+func keysIdentity(cfg *config.Config, _ []string, out io.Writer) error {
+	return withStore(cfg, func(store database.Store) error {
+		storage, err := security.NewServerKeysStorage(store, cfg.Secret)
+		if err != nil {
+			return err
+		}
+		identity, err := storage.Identity()
+		if err != nil {
+			return fmt.Errorf("failed to load server identity key: %w", err)
+		}
+
+		publicKey := hex.EncodeToString(identity.Public().(ed25519.PublicKey))
+		fmt.Fprintln(out, publicKey)
+		fmt.Fprintf(out, "Build the client with: -ldflags \"-X cu/common/e2e.pinnedServerKey=%s\"\n", publicKey)
+		return nil
+	})
+}
+
+// formatTime форматирует время для вывода. Нулевое время выводится как "-".
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,128 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"cu/server/api/database"
+	"cu/server/api/rooms"
+	"cu/server/api/security"
+	"cu/server/config"
+)
+
+// sessionsList выводит действующие сессии. Истекшие сессии, которые хранилище
+// еще не удалило, не выводятся, а только подсчитываются: их удаляет purge-expired.
+func sessionsList(cfg *config.Config, _ []string, out io.Writer) error {
+	return withStore(cfg, func(store database.Store) error {
+		table := newTable(out)
+		fmt.Fprintln(table, "ID\tKEY\tROOM\tTELEGRAM USER\tCLIENT\tLAST USED\tEXPIRES")
+
+		count, expired := 0, 0
+		now := time.Now()
+		err := security.NewSessionStorage(store).ListSessions(func(id string, session *security.ServerSession) error {
+			if now.After(session.ExpiresAt) {
+				expired++
+				return nil
+			}
+			count++
+			telegramUser := "-"
+			if session.TelegramUserID != 0 {
+				telegramUser = fmt.Sprint(session.TelegramUserID)
+			}
+			_, err := fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				id, session.KeyID, orDash(session.RoomID), telegramUser, orDash(session.ClientID),
+				formatTime(session.LastUsed), formatTime(session.ExpiresAt))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list sessions: %w", err)
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d session(s)\n", count)
+		if expired > 0 {
+			fmt.Fprintf(out, "%d expired session(s) not shown, remove them with sessions purge-expired\n", expired)
+		}
+		return nil
+	})
+}
+
+// sessionsRevoke удаляет сессии с указанными идентификаторами и выводит их из комнат.
+// Запущенный сервер закрывает туннели отозванных сессий при их очередной проверке.
+func sessionsRevoke(cfg *config.Config, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: sessions revoke requires at least one session id", ErrUsage)
+	}
+
+	return withStore(cfg, func(store database.Store) error {
+		sessions := security.NewSessionStorage(store)
+		roomStorage := rooms.NewRoomStorage(store, cfg.Rooms.Capacity, cfg.Rooms.IdleTimeout)
+
+		var errs []error
+		for _, id := range args {
+			if err := revokeSession(sessions, roomStorage, id); err != nil {
+				errs = append(errs, fmt.Errorf("session %s: %w", id, err))
+				continue
+			}
+			fmt.Fprintf(out, "Session %s revoked\n", id)
+		}
+		return errors.Join(errs...)
+	})
+}
+
+// sessionsPurgeExpired удаляет сессии, срок жизни которых истек.
+// Обычно хранилище удаляет их само, но срок сессии может истечь раньше срока записи.
+func sessionsPurgeExpired(cfg *config.Config, _ []string, out io.Writer) error {
+	return withStore(cfg, func(store database.Store) error {
+		sessions := security.NewSessionStorage(store)
+		roomStorage := rooms.NewRoomStorage(store, cfg.Rooms.Capacity, cfg.Rooms.IdleTimeout)
+
+		// Сессии удаляются после обхода: изменять хранилище во время чтения нельзя.
+		var expired []string
+		now := time.Now()
+		err := sessions.ListSessions(func(id string, session *security.ServerSession) error {
+			if now.After(session.ExpiresAt) {
+				expired = append(expired, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list sessions: %w", err)
+		}
+
+		var errs []error
+		for _, id := range expired {
+			if err := revokeSession(sessions, roomStorage, id); err != nil {
+				errs = append(errs, fmt.Errorf("session %s: %w", id, err))
+			}
+		}
+		fmt.Fprintf(out, "%d expired session(s) purged\n", len(expired)-len(errs))
+		return errors.Join(errs...)
+	})
+}
+
+// revokeSession выводит сессию id из ее комнаты и удаляет ее.
+func revokeSession(sessions *security.SessionStorage, roomStorage *rooms.RoomStorage, id string) error {
+	session, err := sessions.GetSession(id)
+	if errors.Is(err, database.ErrKeyNotFound) {
+		return errors.New("not found")
+	}
+	if err != nil {
+		return err
+	}
+	if err := roomStorage.Unbind(id, session); err != nil {
+		return fmt.Errorf("failed to leave room: %w", err)
+	}
+	return sessions.DeleteSession(id)
+}
+
+// orDash возвращает "-" вместо пустой строки.
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
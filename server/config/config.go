@@ -1,43 +1,395 @@
 package config
 
 import (
+	"bytes"
+	"cmp"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
+	"net/netip"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
-// PORT server port
-var (
-	PORT      = 0
-	SECRETKEY []byte
-	DBDRIVER  = ""
-	DBURL     = ""
-)
+// DefaultProfile — профиль окружения, используемый, если не задан другой.
+const DefaultProfile = "production"
+
+// MinSecretLength — минимальная длина секрета сервера в байтах.
+const MinSecretLength = 32
+
+// developmentSecret — секрет из .env.development. Он хранится в репозитории,
+// поэтому допустим только в профиле development.
+const developmentSecret = "development-secret-do-not-use-in-production"
+
+// publishedSecrets — секреты, которые были опубликованы в репозитории.
+// Ключи, зашифрованные ими, не защищены, поэтому сервер с таким секретом не запускается.
+var publishedSecrets = map[string]bool{
+	developmentSecret:                      true,
+	"ae6579ab-2ac2-4abd-8a32-a7331b85ce86": true,
+}
+
+// Config содержит конфигурацию сервера.
+type Config struct {
+	// Profile — имя окружения. Определяет файл .env.<Profile>, из которого читается конфигурация.
+	Profile string
+	Port    int
+	// Secret — секрет сервера, из которого выводится ключ шифрования ключей сервера.
+	// Задается переменной окружения API_SECRET или файлом API_SECRET_FILE
+	// вне репозитория, например смонтированным секретом.
+	Secret   []byte
+	LogLevel slog.Level
+	// TrustedProxies — сети обратных прокси, которым разрешено передавать
+	// адрес клиента в заголовке X-Forwarded-For. По умолчанию заголовок не учитывается.
+	TrustedProxies []netip.Prefix
+	Database       DatabaseConfig
+	Rooms          RoomsConfig
+	Keys           KeysConfig
+	Telegram       TelegramConfig
+	RateLimit      RateLimitConfig
+}
+
+// DatabaseConfig содержит параметры подключения к базе данных.
+type DatabaseConfig struct {
+	// Driver — драйвер хранилища: badger, sqlite или postgres.
+	Driver string
+	// Path — путь к данным для badger и sqlite.
+	Path     string
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+	SSLMode  string
+}
+
+// RoomsConfig содержит параметры игровых комнат.
+type RoomsConfig struct {
+	Capacity    int
+	IdleTimeout time.Duration
+}
+
+// KeysConfig содержит параметры ключей сервера.
+type KeysConfig struct {
+	// RotationInterval — период плановой ротации ключей. Ноль отключает ротацию.
+	RotationInterval time.Duration
+}
+
+// TelegramConfig содержит параметры проверки initData Telegram WebApp.
+type TelegramConfig struct {
+	// BotToken — токен бота. Если он пуст, initData не проверяются.
+	BotToken   string
+	AuthMaxAge time.Duration
+}
+
+// RateLimitConfig содержит ограничения частоты запросов.
+// Нулевая скорость отключает соответствующее ограничение.
+type RateLimitConfig struct {
+	// IPRate и IPBurst ограничивают запросы с одного IP-адреса (запросов в секунду).
+	IPRate  float64
+	IPBurst int
+	// SessionRate и SessionBurst ограничивают действия одной сессии (действий в секунду).
+	SessionRate  float64
+	SessionBurst int
+	// MaxSessionsPerClient ограничивает число действующих сессий одного IP-адреса.
+	// Ноль снимает ограничение.
+	MaxSessionsPerClient int
+}
+
+// FieldError описывает ошибку в значении поля конфигурации.
+type FieldError struct {
+	// Field — имя переменной окружения, соответствующей полю.
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// Default возвращает конфигурацию со значениями по умолчанию.
+func Default() *Config {
+	return &Config{
+		Profile: DefaultProfile,
+		Port:    9000,
+		Database: DatabaseConfig{
+			Driver:  "badger",
+			Path:    "./data",
+			SSLMode: "disable",
+		},
+		Rooms: RoomsConfig{
+			Capacity:    8,
+			IdleTimeout: 30 * time.Minute,
+		},
+		Telegram: TelegramConfig{
+			AuthMaxAge: 24 * time.Hour,
+		},
+		RateLimit: RateLimitConfig{
+			IPRate:               5,
+			IPBurst:              20,
+			SessionRate:          20,
+			SessionBurst:         40,
+			MaxSessionsPerClient: 20,
+		},
+	}
+}
+
+// Load загружает конфигурацию по слоям, каждый следующий переопределяет предыдущий:
+// значения по умолчанию, файл .env.<профиль> (если он есть), переменные окружения
+// и флаги командной строки args. Профиль задается флагом -profile или переменной APP_ENV.
+// Аргументы после флагов возвращаются вторым значением.
+// Если некорректны значения полей, вместе с ошибкой возвращается загруженная
+// конфигурация, чтобы ее можно было показать пользователю.
+func Load(args []string) (*Config, []string, error) {
+	cfg := Default()
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	profile := flags.String("profile", "", "environment profile, selects the .env.<profile> file")
+	envFile := flags.String("env-file", "", "path to the env file, overrides the profile file")
+	port := flags.Int("port", 0, "HTTP port")
+	dbDriver := flags.String("db-driver", "", "database driver: badger, sqlite or postgres")
+	dbPath := flags.String("db-path", "", "database path for badger and sqlite")
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	cfg.Profile = cmp.Or(*profile, os.Getenv("APP_ENV"), DefaultProfile)
+
+	// Файл профиля необязателен, но явно указанный файл должен существовать.
+	path := ".env." + cfg.Profile
+	if *envFile != "" {
+		path = *envFile
+	}
+	file, err := godotenv.Read(path)
+	if errors.Is(err, fs.ErrNotExist) && *envFile == "" {
+		file = map[string]string{}
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	lookup := func(key string) (string, bool) {
+		if value, ok := os.LookupEnv(key); ok {
+			return value, true
+		}
+		value, ok := file[key]
+		return value, ok
+	}
+	parseErr := cfg.apply(lookup)
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "db-driver":
+			cfg.Database.Driver = *dbDriver
+		case "db-path":
+			cfg.Database.Path = *dbPath
+		}
+	})
+
+	return cfg, flags.Args(), errors.Join(parseErr, cfg.Validate())
+}
+
+// apply переносит в конфигурацию значения, найденные функцией lookup.
+// Ошибки разбора всех полей собираются вместе.
+func (c *Config) apply(lookup func(key string) (string, bool)) error {
+	var errs []error
+	str := func(key string, target *string) {
+		if value, ok := lookup(key); ok {
+			*target = value
+		}
+	}
+	integer := func(key string, target *int) {
+		if value, ok := lookup(key); ok && value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, &FieldError{Field: key, Message: fmt.Sprintf("invalid integer %q", value)})
+				return
+			}
+			*target = parsed
+		}
+	}
+	duration := func(key string, target *time.Duration) {
+		if value, ok := lookup(key); ok && value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, &FieldError{Field: key, Message: fmt.Sprintf("invalid duration %q", value)})
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	float := func(key string, target *float64) {
+		if value, ok := lookup(key); ok && value != "" {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				errs = append(errs, &FieldError{Field: key, Message: fmt.Sprintf("invalid number %q", value)})
+				return
+			}
+			*target = parsed
+		}
+	}
+
+	integer("API_PORT", &c.Port)
+	if value, ok := lookup("API_SECRET"); ok {
+		c.Secret = []byte(value)
+	}
+	// Файл секрета переопределяет API_SECRET.
+	if path, ok := lookup("API_SECRET_FILE"); ok && path != "" {
+		secret, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, &FieldError{Field: "API_SECRET_FILE", Message: fmt.Sprintf("failed to read secret: %v", err)})
+		} else {
+			c.Secret = bytes.TrimRight(secret, "\r\n")
+		}
+	}
+	if value, ok := lookup("LOG_LEVEL"); ok && value != "" {
+		if err := c.LogLevel.UnmarshalText([]byte(value)); err != nil {
+			errs = append(errs, &FieldError{Field: "LOG_LEVEL", Message: fmt.Sprintf("invalid level %q", value)})
+		}
+	}
+
+	if value, ok := lookup("TRUSTED_PROXIES"); ok {
+		proxies, err := parsePrefixes(value)
+		if err != nil {
+			errs = append(errs, &FieldError{Field: "TRUSTED_PROXIES", Message: err.Error()})
+		} else {
+			c.TrustedProxies = proxies
+		}
+	}
+
+	str("DB_DRIVER", &c.Database.Driver)
+	str("DB_PATH", &c.Database.Path)
+	str("DB_HOST", &c.Database.Host)
+	str("DB_PORT", &c.Database.Port)
+	str("DB_USER", &c.Database.User)
+	str("DB_PASSWORD", &c.Database.Password)
+	str("DB_NAME", &c.Database.Name)
+	str("DB_SSLMODE", &c.Database.SSLMode)
+
+	integer("ROOM_CAPACITY", &c.Rooms.Capacity)
+	duration("ROOM_IDLE_TIMEOUT", &c.Rooms.IdleTimeout)
+
+	duration("KEY_ROTATION_INTERVAL", &c.Keys.RotationInterval)
+
+	str("TELEGRAM_BOT_TOKEN", &c.Telegram.BotToken)
+	duration("TELEGRAM_AUTH_MAX_AGE", &c.Telegram.AuthMaxAge)
+
+	float("RATE_LIMIT_IP_RATE", &c.RateLimit.IPRate)
+	integer("RATE_LIMIT_IP_BURST", &c.RateLimit.IPBurst)
+	float("RATE_LIMIT_SESSION_RATE", &c.RateLimit.SessionRate)
+	integer("RATE_LIMIT_SESSION_BURST", &c.RateLimit.SessionBurst)
+	integer("MAX_SESSIONS_PER_CLIENT", &c.RateLimit.MaxSessionsPerClient)
+
+	return errors.Join(errs...)
+}
+
+// Validate проверяет конфигурацию и возвращает ошибки всех некорректных полей.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(field, message string) {
+		errs = append(errs, &FieldError{Field: field, Message: message})
+	}
+
+	if c.Port <= 0 || c.Port > 65535 {
+		invalid("API_PORT", fmt.Sprintf("port %d is out of range", c.Port))
+	}
+	switch {
+	case len(c.Secret) == 0:
+		invalid("API_SECRET", "must be set in the environment or in the file named by API_SECRET_FILE")
+	case publishedSecrets[string(c.Secret)] && !c.allowsDevelopmentSecret():
+		invalid("API_SECRET", "is a published placeholder, generate a new secret: openssl rand -hex 32")
+	case len(c.Secret) < MinSecretLength:
+		invalid("API_SECRET", fmt.Sprintf("must be at least %d bytes long", MinSecretLength))
+	}
+
+	switch c.Database.Driver {
+	case "badger", "sqlite":
+		if c.Database.Path == "" {
+			invalid("DB_PATH", "must not be empty for the "+c.Database.Driver+" driver")
+		}
+	case "postgres":
+		if c.Database.Host == "" {
+			invalid("DB_HOST", "must not be empty for the postgres driver")
+		}
+		if c.Database.Name == "" {
+			invalid("DB_NAME", "must not be empty for the postgres driver")
+		}
+	default:
+		invalid("DB_DRIVER", fmt.Sprintf("unsupported driver %q", c.Database.Driver))
+	}
 
-// Load server PORT
-func Load() {
-	var err error
-	err = godotenv.Load(".env.production")
-	if err != nil {
-		log.Fatal("Error loading .env file ", err)
-	}
-	PORT, err = strconv.Atoi(os.Getenv("API_PORT"))
-	if err != nil {
-		PORT = 9000
-	}
-
-	DBDRIVER = os.Getenv("DB_DRIVER")
-	DBURL = fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s sslmode=%s",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_NAME"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_SSLMODE"),
-	)
-
-	SECRETKEY = []byte(os.Getenv(("API_SCECRET")))
-}
\ No newline at end of file
+	if c.Rooms.Capacity <= 0 {
+		invalid("ROOM_CAPACITY", "must be positive")
+	}
+	if c.Rooms.IdleTimeout <= 0 {
+		invalid("ROOM_IDLE_TIMEOUT", "must be positive")
+	}
+	if c.Keys.RotationInterval < 0 {
+		invalid("KEY_ROTATION_INTERVAL", "must not be negative")
+	}
+	if c.Telegram.AuthMaxAge <= 0 {
+		invalid("TELEGRAM_AUTH_MAX_AGE", "must be positive")
+	}
+
+	if c.RateLimit.IPRate < 0 {
+		invalid("RATE_LIMIT_IP_RATE", "must not be negative")
+	}
+	if c.RateLimit.IPRate > 0 && c.RateLimit.IPBurst < 1 {
+		invalid("RATE_LIMIT_IP_BURST", "must be at least 1")
+	}
+	if c.RateLimit.SessionRate < 0 {
+		invalid("RATE_LIMIT_SESSION_RATE", "must not be negative")
+	}
+	if c.RateLimit.SessionRate > 0 && c.RateLimit.SessionBurst < 1 {
+		invalid("RATE_LIMIT_SESSION_BURST", "must be at least 1")
+	}
+	if c.RateLimit.MaxSessionsPerClient < 0 {
+		invalid("MAX_SESSIONS_PER_CLIENT", "must not be negative")
+	}
+
+	return errors.Join(errs...)
+}
+
+// allowsDevelopmentSecret сообщает, что задан секрет из .env.development в профиле development.
+func (c *Config) allowsDevelopmentSecret() bool {
+	return c.Profile == "development" && string(c.Secret) == developmentSecret
+}
+
+// DataSource возвращает строку подключения для выбранного драйвера базы данных:
+// путь к данным для badger и sqlite, строку подключения для postgres.
+func (c DatabaseConfig) DataSource() string {
+	if c.Driver == "postgres" {
+		return fmt.Sprintf("host=%s port=%s user=%s dbname=%s password=%s sslmode=%s",
+			c.Host, c.Port, c.User, c.Name, c.Password, c.SSLMode)
+	}
+	return c.Path
+}
+
+// parsePrefixes разбирает список сетей через запятую. Адрес без длины префикса
+// обозначает один узел.
+func parsePrefixes(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(field); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", field)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,205 @@
+package config
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testSecret — секрет достаточной длины, не входящий в publishedSecrets.
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// writeFile записывает content во временный файл и возвращает его путь.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fieldErrors возвращает имена полей из всех *FieldError в err.
+func fieldErrors(err error) []string {
+	var fields []string
+	var walk func(err error)
+	walk = func(err error) {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, err := range joined.Unwrap() {
+				walk(err)
+			}
+			return
+		}
+		var fieldErr *FieldError
+		if errors.As(err, &fieldErr) {
+			fields = append(fields, fieldErr.Field)
+		}
+	}
+	walk(err)
+	return fields
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	envFile := writeFile(t, ".env.test", `
+API_PORT=7000
+ROOM_CAPACITY=4
+ROOM_IDLE_TIMEOUT=1m
+DB_DRIVER=sqlite
+`)
+	t.Setenv("API_SECRET", testSecret)
+	t.Setenv("API_PORT", "8000")
+	t.Setenv("ROOM_IDLE_TIMEOUT", "2m")
+	t.Setenv("APP_ENV", "staging")
+
+	cfg, args, err := Load([]string{"-env-file", envFile, "-profile", "test", "-port", "9100", "serve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		got, want any
+	}{
+		{"Profile from flag over APP_ENV", cfg.Profile, "test"},
+		{"Port from flag over env and file", cfg.Port, 9100},
+		{"IdleTimeout from env over file", cfg.Rooms.IdleTimeout, 2 * time.Minute},
+		{"Capacity from file over default", cfg.Rooms.Capacity, 4},
+		{"Driver from file over default", cfg.Database.Driver, "sqlite"},
+		{"Path from default", cfg.Database.Path, Default().Database.Path},
+		{"Secret from env", string(cfg.Secret), testSecret},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+	if !slices.Equal(args, []string{"serve"}) {
+		t.Errorf("remaining args are %q, want [serve]", args)
+	}
+}
+
+func TestLoadProfileFromEnv(t *testing.T) {
+	t.Setenv("API_SECRET", testSecret)
+	t.Setenv("APP_ENV", "staging")
+
+	// Файл профиля необязателен: без него используются значения по умолчанию.
+	cfg, _, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Profile != "staging" || cfg.Port != Default().Port {
+		t.Fatalf("Load returned profile %q and port %d", cfg.Profile, cfg.Port)
+	}
+
+	if _, _, err := Load([]string{"-env-file", filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Fatal("Load accepted a missing explicit env file")
+	}
+}
+
+func TestLoadSecretFile(t *testing.T) {
+	t.Setenv("API_SECRET", "ignored because the file takes precedence")
+	t.Setenv("API_SECRET_FILE", writeFile(t, "secret", testSecret+"\r\n"))
+
+	cfg, _, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cfg.Secret) != testSecret {
+		t.Fatalf("secret is %q, want %q", cfg.Secret, testSecret)
+	}
+
+	t.Setenv("API_SECRET_FILE", filepath.Join(t.TempDir(), "missing"))
+	_, _, err = Load(nil)
+	if fields := fieldErrors(err); !slices.Contains(fields, "API_SECRET_FILE") {
+		t.Fatalf("Load returned %v, want an API_SECRET_FILE error", err)
+	}
+}
+
+func TestLoadParseErrors(t *testing.T) {
+	t.Setenv("API_SECRET", testSecret)
+	t.Setenv("API_PORT", "http")
+	t.Setenv("ROOM_IDLE_TIMEOUT", "forever")
+	t.Setenv("RATE_LIMIT_IP_RATE", "fast")
+	t.Setenv("LOG_LEVEL", "loud")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8,proxy")
+
+	cfg, _, err := Load(nil)
+	want := []string{"API_PORT", "LOG_LEVEL", "TRUSTED_PROXIES", "ROOM_IDLE_TIMEOUT", "RATE_LIMIT_IP_RATE"}
+	if fields := fieldErrors(err); !slices.Equal(fields, want) {
+		t.Fatalf("Load reported fields %q, want %q", fields, want)
+	}
+	// Некорректные значения не заменяют значения по умолчанию.
+	if cfg.Port != Default().Port || cfg.Rooms.IdleTimeout != Default().Rooms.IdleTimeout {
+		t.Fatalf("invalid values were applied: %+v", cfg)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	t.Setenv("API_SECRET", testSecret)
+	t.Setenv("TRUSTED_PROXIES", " 10.1.2.3/8, 192.168.1.1,, ::ffff:172.16.0.1, 2001:db8::/32 ")
+
+	cfg, _, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.1/32"),
+		netip.MustParsePrefix("172.16.0.1/32"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+	if !slices.Equal(cfg.TrustedProxies, want) {
+		t.Fatalf("TrustedProxies are %v, want %v", cfg.TrustedProxies, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		want   []string
+	}{
+		{"Valid", func(cfg *Config) {}, nil},
+		{"MissingSecret", func(cfg *Config) { cfg.Secret = nil }, []string{"API_SECRET"}},
+		{"ShortSecret", func(cfg *Config) { cfg.Secret = []byte("short") }, []string{"API_SECRET"}},
+		{"PublishedSecret", func(cfg *Config) { cfg.Secret = []byte("ae6579ab-2ac2-4abd-8a32-a7331b85ce86") }, []string{"API_SECRET"}},
+		{"DevelopmentSecretInProduction", func(cfg *Config) { cfg.Secret = []byte(developmentSecret) }, []string{"API_SECRET"}},
+		{"DevelopmentSecretInDevelopment", func(cfg *Config) {
+			cfg.Profile = "development"
+			cfg.Secret = []byte(developmentSecret)
+		}, nil},
+		{"Port", func(cfg *Config) { cfg.Port = 70000 }, []string{"API_PORT"}},
+		{"Driver", func(cfg *Config) { cfg.Database.Driver = "mysql" }, []string{"DB_DRIVER"}},
+		{"EmptyPath", func(cfg *Config) { cfg.Database.Path = "" }, []string{"DB_PATH"}},
+		{"Postgres", func(cfg *Config) { cfg.Database.Driver = "postgres" }, []string{"DB_HOST", "DB_NAME"}},
+		{"Rooms", func(cfg *Config) {
+			cfg.Rooms.Capacity = 0
+			cfg.Rooms.IdleTimeout = 0
+		}, []string{"ROOM_CAPACITY", "ROOM_IDLE_TIMEOUT"}},
+		{"RotationInterval", func(cfg *Config) { cfg.Keys.RotationInterval = -time.Hour }, []string{"KEY_ROTATION_INTERVAL"}},
+		{"AuthMaxAge", func(cfg *Config) { cfg.Telegram.AuthMaxAge = 0 }, []string{"TELEGRAM_AUTH_MAX_AGE"}},
+		{"RateLimits", func(cfg *Config) {
+			cfg.RateLimit.IPBurst = 0
+			cfg.RateLimit.SessionRate = -1
+			cfg.RateLimit.MaxSessionsPerClient = -1
+		}, []string{"RATE_LIMIT_IP_BURST", "RATE_LIMIT_SESSION_RATE", "MAX_SESSIONS_PER_CLIENT"}},
+		{"DisabledRateLimitIgnoresBurst", func(cfg *Config) {
+			cfg.RateLimit.SessionRate = 0
+			cfg.RateLimit.SessionBurst = 0
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Secret = []byte(testSecret)
+			test.modify(cfg)
+			if fields := fieldErrors(cfg.Validate()); !slices.Equal(fields, test.want) {
+				t.Fatalf("Validate reported fields %q, want %q", fields, test.want)
+			}
+		})
+	}
+}
@@ -2,10 +2,42 @@ package main
 
 import (
 	"cu/server/api"
+	"cu/server/api/logging"
+	"cu/server/cli"
 	"cu/server/config"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
 )
 
 func main() {
-	api.Init()
-	api.StartServer(config.PORT)
+	slog.SetDefault(logging.New(os.Stdout, slog.LevelInfo))
+
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	// Административные команды выводят результат для человека, а не в журнал.
+	if cli.IsCommand(args) {
+		if err := cli.Run(cfg, err, args, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err != nil {
+		slog.Error("Invalid configuration", logging.Error(err))
+		os.Exit(1)
+	}
+	slog.SetDefault(logging.New(os.Stdout, cfg.LogLevel))
+	slog.Info("Configuration loaded successfully")
+
+	if err := api.StartServer(cfg); err != nil {
+		slog.Error("Server failed", logging.Error(err))
+		os.Exit(1)
+	}
 }